@@ -0,0 +1,57 @@
+// Command runner executes code for the API server in a process of its own,
+// so that a run that crashes or exhausts memory cannot take the API server
+// down, and so runs can be held to OS-level limits. The API server sends it
+// the languages listed in EXEC_REMOTE_LANGUAGES over EXEC_RUNNER_SOCKET.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"backend/internal/executor"
+	"backend/internal/languages"
+)
+
+func main() {
+	socket := os.Getenv("EXEC_RUNNER_SOCKET")
+	if socket == "" {
+		socket = "/tmp/runner.sock"
+	}
+
+	registry, err := languages.FromEnv()
+	if err != nil {
+		log.Fatalf("Could not load languages: %v", err)
+	}
+	// The runner runs everything itself.
+	engine := executor.NewEngineWithConfig(executor.EngineConfig{
+		Pool:      executor.PoolConfigFromEnv(),
+		Languages: registry,
+	})
+	defer engine.Close(context.Background())
+
+	// A socket left behind by a runner that didn't shut down cleanly.
+	if err := os.Remove(socket); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Fatalf("Could not remove stale socket %s: %v", socket, err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		log.Fatalf("Could not listen on %s: %v", socket, err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	log.Printf("Runner listening on %s", socket)
+	if err := executor.Serve(l, engine); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatal("Serve:", err)
+	}
+}
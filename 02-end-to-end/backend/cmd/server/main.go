@@ -6,27 +6,64 @@ import (
 	"os"
 
 	"backend/internal/api"
+	"backend/internal/auth"
 	"backend/internal/db"
 	"backend/internal/session"
 	"backend/internal/users"
 	"backend/internal/ws"
 )
 
+// newHub sets up the WebSocket hub. With WS_BACKPLANE=postgres, replicas
+// share sessions through Postgres LISTEN/NOTIFY; otherwise the hub is the
+// only instance.
+func newHub(store *session.Store) *ws.Hub {
+	switch backplane := os.Getenv("WS_BACKPLANE"); backplane {
+	case "", "none":
+		return ws.NewHub(store)
+	case "postgres":
+		b, err := ws.NewPostgresBackplane(db.GetDB(), db.DSN())
+		if err != nil {
+			log.Fatalf("Could not start Postgres backplane: %v", err)
+		}
+		log.Println("Using Postgres backplane for WebSocket sessions")
+		return ws.NewHubWithBackplane(store, b)
+	default:
+		log.Fatalf("Unknown WS_BACKPLANE %q", backplane)
+		return nil
+	}
+}
+
 func main() {
+	// Keys tokens are signed and verified with
+	keys, configured, err := auth.KeysFromEnv()
+	if err != nil {
+		log.Fatalf("Could not load JWT keys: %v", err)
+	}
+	if !configured {
+		log.Println("WARNING: no JWT key configured; signing tokens with the built-in development secret")
+	}
+	auth.SetKeys(keys)
+
 	// Initialize Database
 	db.Init()
 
 	// Initialize components
 	store := session.NewStore()
 	userStore := users.NewStore()
-	hub := ws.NewHub()
-
-	// Start WebSocket Hub
-	go hub.Run()
+	hub := newHub(store)
 
 	// Initialize API Server
 	server := api.NewServer(store, userStore, hub)
 
+	// Runs started from a session use the same executor as /execute, and
+	// sessions may only switch to languages it can run
+	hub.Runner = server.Executor
+	hub.Languages = server.Executor.Languages()
+	store.Languages = server.Languages
+
+	// Start WebSocket Hub
+	go hub.Run()
+
 	// Setup Router
 	mux := server.SetupRoutes()
 
@@ -3,33 +3,67 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"backend/internal/auth"
 	"backend/internal/executor"
+	"backend/internal/languages"
 	"backend/internal/models"
 	"backend/internal/session"
 	"backend/internal/users" // Added for user management
 	"backend/internal/ws"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// runHistoryLimit is how many runs GET /sessions/{id}/runs returns.
+	runHistoryLimit = 50
+
+	// executeTimeout bounds a run of POST /execute once it has a worker.
+	executeTimeout = 10 * time.Second
+
+	// defaultInviteExpiry and maxInviteExpiry bound how long an invite can
+	// be used for.
+	defaultInviteExpiry = 7 * 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+
+	// maxGuestNameLength bounds the name a guest picks, in characters.
+	maxGuestNameLength = 40
+)
+
 type Server struct {
 	Store     *session.Store
 	UserStore *users.Store // Added UserStore
 	Hub       *ws.Hub
 	Executor  *executor.Engine
+	Languages *languages.Registry
 }
 
+// NewServer sets up the languages of languages.FromEnv and an executor for
+// them.
 func NewServer(store *session.Store, userStore *users.Store, hub *ws.Hub) *Server { // Added userStore parameter
+	registry, err := languages.FromEnv()
+	if err != nil {
+		log.Fatalf("Could not load languages: %v", err)
+	}
+	config := executor.EngineConfigFromEnv()
+	config.Languages = registry
+
 	return &Server{
 		Store:     store,
 		UserStore: userStore, // Initialized UserStore
 		Hub:       hub,
-		Executor:  executor.NewEngine(),
+		Executor:  executor.NewEngineWithConfig(config),
+		Languages: registry,
 	}
 }
 
@@ -64,21 +98,12 @@ func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Auto login
-	token, err := auth.GenerateToken(user.ID, user.Username)
+	refreshToken, err := s.UserStore.CreateRefreshToken(user.ID)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-
-	resp := models.AuthResponse{
-		Token:    token,
-		UserID:   user.ID,
-		Username: user.Username,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(resp)
+	writeTokens(w, http.StatusCreated, user, refreshToken)
 }
 
 // LoginHandler handles POST /login
@@ -100,6 +125,71 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	refreshToken, err := s.UserStore.CreateRefreshToken(user.ID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, http.StatusOK, user, refreshToken)
+}
+
+// RefreshTokenHandler handles POST /token/refresh, trading a refresh token
+// for a new token and the next refresh token.
+func (s *Server) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, user, err := s.UserStore.RotateRefreshToken(req.RefreshToken)
+	if errors.Is(err, users.ErrInvalidRefreshToken) {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeTokens(w, http.StatusOK, user, refreshToken)
+}
+
+// LogoutHandler handles POST /logout: the caller's token stops working, and
+// so does the refresh token they send, if any, with those it replaced.
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The refresh token is optional, and so is the body.
+	var req models.RefreshRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	claims := claimsFrom(r)
+	if claims.ID != "" && claims.ExpiresAt != nil {
+		if err := s.UserStore.RevokeToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.RefreshToken != "" {
+		if err := s.UserStore.RevokeRefreshToken(req.RefreshToken); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeTokens answers a sign in or a refresh with a new token for user and
+// their refresh token.
+func writeTokens(w http.ResponseWriter, status int, user *models.User, refreshToken string) {
 	token, err := auth.GenerateToken(user.ID, user.Username)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -107,15 +197,39 @@ func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := models.AuthResponse{
-		Token:    token,
-		UserID:   user.ID,
-		Username: user.Username,
+		Token:        token,
+		ExpiresIn:    int(auth.AccessTokenExpiry / time.Second),
+		RefreshToken: refreshToken,
+		UserID:       user.ID,
+		Username:     user.Username,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// validateToken validates a token, refusing one that was revoked.
+func (s *Server) validateToken(token string) (*auth.Claims, error) {
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserStore.IsTokenRevoked(claims.ID) {
+		return nil, errors.New("token revoked")
+	}
+	return claims, nil
+}
+
+// claimsKey is the request context key of the caller's token claims.
+type claimsKey struct{}
+
+// claimsFrom returns the claims AuthMiddleware validated for the request.
+func claimsFrom(r *http.Request) *auth.Claims {
+	claims, _ := r.Context().Value(claimsKey{}).(*auth.Claims)
+	return claims
+}
+
 // AuthMiddleware protects routes
 func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -139,18 +253,17 @@ func (s *Server) AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		}
 
 		tokenStr := parts[1]
-		claims, err := auth.ValidateToken(tokenStr)
+		claims, err := s.validateToken(tokenStr)
 		if err != nil {
 			http.Error(w, "Invalid token", http.StatusUnauthorized)
 			return
 		}
+		if claims.Guest {
+			http.Error(w, "Guests can only join their session", http.StatusForbidden)
+			return
+		}
 
-		// Add context? (Optional, skipping for brevity unless needed)
-		// r = r.WithContext(context.WithValue(r.Context(), "user", claims))
-
-		_ = claims // Used for validation only for now
-
-		next(w, r)
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
 	}
 }
 
@@ -165,7 +278,24 @@ func (s *Server) CreateSessionHandler(w http.ResponseWriter, r *http.Request) {
 	// Decode optional body, but ignore errors if empty
 	_ = json.NewDecoder(r.Body).Decode(&req)
 
-	session := s.Store.CreateSession(req.Language)
+	if !s.Executor.Supports(req.Language) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(models.UnsupportedLanguageResponse{
+			Error:              fmt.Sprintf("unsupported language: %q", req.Language),
+			SupportedLanguages: s.Executor.Languages(),
+		})
+		return
+	}
+
+	// A new session starts with a single file, the language's template.
+	entrypoint, template := "main", ""
+	if lang, ok := s.Languages.Get(req.Language); ok {
+		entrypoint, template = lang.DefaultEntrypoint(), lang.Template
+	}
+	claims := claimsFrom(r)
+	owner := models.SessionMember{UserID: claims.UserID, UserName: claims.Username}
+	session := s.Store.CreateSession(owner, req.Language, entrypoint, template)
 
 	resp := models.CreateSessionResponse{
 		SessionID: session.ID,
@@ -191,27 +321,49 @@ func (s *Server) GetSessionHandler(w http.ResponseWriter, r *http.Request) {
 		id := r.URL.Path[len("/sessions/"):]
 
 		// Auth check for WS (via query param usually)
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			// Try header? Spec says standard JS WebSocket API doesn't allow custom headers easily.
-			// Usually query param or copy protocol.
-			// Let's rely on Query Param `?token=...`
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		// Spec says standard JS WebSocket API doesn't allow custom headers easily,
+		// so the token is passed as `?token=...`, an invite as `?invite=...`.
+		claims, role, ok := s.joinSession(w, r, id, r.URL.Query().Get("token"), session.ActionView)
+		if !ok {
 			return
 		}
 
-		_, err := auth.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
-
-		ws.ServeWs(s.Hub, w, r, id)
+		ws.ServeWs(s.Hub, w, r, id, claims, role)
 		return
 	}
 
 	// Normal HTTP GET (Protected via Middleware if wrapped, but let's check manually or wrapper)
 	id := r.URL.Path[len("/sessions/"):]
+	if sessionID, ok := strings.CutSuffix(id, "/runs"); ok {
+		s.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			s.ListRunsHandler(w, r, sessionID)
+		})(w, r)
+		return
+	}
+	if sessionID, userID, ok := strings.Cut(id, "/members"); ok && (userID == "" || userID[0] == '/') {
+		s.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			s.MembersHandler(w, r, sessionID, strings.TrimPrefix(userID, "/"))
+		})(w, r)
+		return
+	}
+	if sessionID, inviteID, ok := strings.Cut(id, "/invites"); ok && (inviteID == "" || inviteID[0] == '/') {
+		s.AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			s.InvitesHandler(w, r, sessionID, strings.TrimPrefix(inviteID, "/"))
+		})(w, r)
+		return
+	}
+	if sessionID, ok := strings.CutSuffix(id, "/guests"); ok {
+		s.JoinAsGuestHandler(w, r, sessionID)
+		return
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, _, ok := s.joinSession(w, r, id, token, session.ActionView); !ok {
+		return
+	}
+
+	// Live edits are saved with a delay; make sure we return the latest code.
+	s.Hub.FlushSession(id)
 	session, ok := s.Store.GetSession(id)
 	if !ok {
 		http.Error(w, "Session not found", http.StatusNotFound)
@@ -239,30 +391,485 @@ func (s *Server) ExecuteCodeHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Code and Language are required", http.StatusBadRequest)
 		return
 	}
+	if err := executor.ValidateFiles(req.Entrypoint, req.Files); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	ctx := r.Context()
-	// Set timeout
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+	claims := claimsFrom(r)
+	execReq := &executor.Request{
+		Code:       req.Code,
+		Entrypoint: req.Entrypoint,
+		Files:      req.Files,
+		Stdin:      req.Stdin,
+		Args:       req.Args,
+		Owner:      claims.UserID,
+		Timeout:    executeTimeout,
+	}
+
+	// A run for a session is shared with everyone in it and kept in its
+	// history.
+	var run *models.Run
+	if req.SessionID != "" {
+		if _, ok := s.authorize(w, req.SessionID, claims, session.ActionRun); !ok {
+			return
+		}
+		run = &models.Run{
+			ID:        uuid.New().String(),
+			SessionID: req.SessionID,
+			UserID:    claims.UserID,
+			UserName:  claims.Username,
+			Language:  req.Language,
+			CodeHash:  executor.CodeHash(req.Code, req.Files),
+		}
+		s.Hub.PublishRunStarted(req.SessionID, &ws.RunInfo{
+			ID:       run.ID,
+			UserID:   run.UserID,
+			UserName: run.UserName,
+			Language: run.Language,
+			CodeHash: run.CodeHash,
+		})
+		execReq.Queued = func(position int) {
+			s.Hub.PublishRunQueued(req.SessionID, run.ID, position)
+		}
+	}
 
 	start := time.Now()
-	output, err := s.Executor.Execute(ctx, req.Code, req.Language)
-	duration := time.Since(start).Milliseconds()
+	result, err := s.Executor.Execute(r.Context(), req.Language, execReq)
+	resp := executor.NewResponse(result, err, time.Since(start))
+
+	var busy *executor.BusyError
+	if errors.As(err, &busy) {
+		// The run never started, so there is nothing to keep.
+		if run != nil {
+			s.Hub.PublishRunExit(req.SessionID, run.ID, &resp)
+		}
+		writeBusy(w, busy)
+		return
+	}
+
+	if run != nil {
+		run.Finish(resp)
+		s.Store.RecordRun(run)
+		s.Hub.PublishRunExit(req.SessionID, run.ID, &resp)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ExecuteTestsHandler handles POST /execute/tests, running code against
+// each of the test cases given.
+func (s *Server) ExecuteTestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.ExecuteTestsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Code == "" || req.Language == "" {
+		http.Error(w, "Code and Language are required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Tests) == 0 || len(req.Tests) > executor.MaxTestCases {
+		http.Error(w, fmt.Sprintf("Between 1 and %d tests are required", executor.MaxTestCases), http.StatusBadRequest)
+		return
+	}
+	if err := executor.ValidateFiles(req.Entrypoint, req.Files); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := executor.RunTests(r.Context(), s.Executor.Execute, &req, claimsFrom(r).UserID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeBusy turns a run away: with 429 if the user has too many runs
+// waiting, and 503 if everyone does.
+func writeBusy(w http.ResponseWriter, busy *executor.BusyError) {
+	status := http.StatusServiceUnavailable
+	if errors.Is(busy, executor.ErrTooManyQueued) {
+		status = http.StatusTooManyRequests
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(busy.RetryAfter.Round(time.Second)/time.Second)))
+	http.Error(w, busy.Error(), status)
+}
+
+// ListLanguagesHandler handles GET /languages
+func (s *Server) ListLanguagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Languages.Infos())
+}
+
+// JWKSHandler handles GET /.well-known/jwks.json, the public keys tokens are
+// verified with, so that other services can verify them.
+func (s *Server) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": auth.JWKS()})
+}
+
+// ListRunsHandler handles GET /sessions/{id}/runs, the session's most recent
+// runs, newest first.
+func (s *Server) ListRunsHandler(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.authorize(w, sessionID, claimsFrom(r), session.ActionView); !ok {
+		return
+	}
+
+	runs, err := s.Store.ListRuns(sessionID, runHistoryLimit)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
+
+// MembersHandler handles /sessions/{id}/members: GET lists the members of a
+// session, POST gives a user a role in it and DELETE /sessions/{id}/members/{userId}
+// takes a user's role away. Only the owner can change who is a member.
+func (s *Server) MembersHandler(w http.ResponseWriter, r *http.Request, sessionID, userID string) {
+	action := session.ActionManage
+	switch {
+	case r.Method == http.MethodGet && userID == "":
+		action = session.ActionView
+	case r.Method == http.MethodPost && userID == "":
+	case r.Method == http.MethodDelete && userID != "":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.authorize(w, sessionID, claimsFrom(r), action); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		members, err := s.Store.ListMembers(sessionID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+
+	case http.MethodPost:
+		var req models.AddMemberRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !session.ValidRole(req.Role) || req.Role == session.RoleOwner {
+			http.Error(w, fmt.Sprintf("Invalid role: %q", req.Role), http.StatusBadRequest)
+			return
+		}
+		user, ok := s.UserStore.GetUserByUsername(req.Username)
+		if !ok {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if role, _ := s.Store.Role(sessionID, user.ID); role == session.RoleOwner {
+			http.Error(w, "The owner's role can't be changed", http.StatusBadRequest)
+			return
+		}
+
+		member := models.SessionMember{UserID: user.ID, UserName: user.Username, Role: req.Role}
+		if err := s.Store.SetMember(sessionID, member); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.Hub.PublishMember(sessionID, member.UserID, member.Role)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(member)
+
+	case http.MethodDelete:
+		if role, _ := s.Store.Role(sessionID, userID); role == session.RoleOwner {
+			http.Error(w, "The owner can't be removed", http.StatusBadRequest)
+			return
+		}
+		if err := s.Store.RemoveMember(sessionID, userID); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		s.Hub.PublishMember(sessionID, userID, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// InvitesHandler handles /sessions/{id}/invites: GET lists the invites that
+// can still be used, POST creates one and DELETE /sessions/{id}/invites/{inviteId}
+// revokes one, disconnecting those who joined with it. Only the owner manages
+// invites.
+func (s *Server) InvitesHandler(w http.ResponseWriter, r *http.Request, sessionID, inviteID string) {
+	switch {
+	case r.Method == http.MethodGet && inviteID == "":
+	case r.Method == http.MethodPost && inviteID == "":
+	case r.Method == http.MethodDelete && inviteID != "":
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims := claimsFrom(r)
+	if _, ok := s.authorize(w, sessionID, claims, session.ActionManage); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		invites, err := s.Store.ListInvites(sessionID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(invites)
+
+	case http.MethodPost:
+		var req models.CreateInviteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !session.ValidRole(req.Role) || req.Role == session.RoleOwner {
+			http.Error(w, fmt.Sprintf("Invalid role: %q", req.Role), http.StatusBadRequest)
+			return
+		}
+		expiresIn := defaultInviteExpiry
+		if req.ExpiresIn != 0 {
+			expiresIn = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if expiresIn <= 0 || expiresIn > maxInviteExpiry {
+			http.Error(w, fmt.Sprintf("An invite can be valid for at most %v", maxInviteExpiry), http.StatusBadRequest)
+			return
+		}
+
+		invite := models.Invite{
+			ID:        uuid.New().String(),
+			SessionID: sessionID,
+			Role:      req.Role,
+			CreatedBy: claims.UserID,
+			ExpiresAt: time.Now().Add(expiresIn),
+		}
+		token, err := auth.GenerateInviteToken(invite.ID, sessionID, invite.Role, invite.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.Store.CreateInvite(&invite); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
-	resp := models.ExecuteResponse{
-		Success:       err == nil,
-		Output:        output,
-		ExecutionTime: duration,
+		resp := models.CreateInviteResponse{
+			Invite: invite,
+			Token:  token,
+			Link:   "/session/" + sessionID + "?invite=" + token,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodDelete:
+		revoked, removed, err := s.Store.RevokeInvite(sessionID, inviteID)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !revoked {
+			http.Error(w, "Invite not found", http.StatusNotFound)
+			return
+		}
+		s.Hub.PublishInviteRevoked(sessionID, inviteID)
+		for _, userID := range removed {
+			s.Hub.PublishMember(sessionID, userID, "")
+		}
+		w.WriteHeader(http.StatusNoContent)
 	}
+}
 
+// JoinAsGuestHandler handles POST /sessions/{id}/guests: someone opening an
+// invite without an account picks a name, and gets a token that lets them
+// join the session, and only it, as a guest.
+func (s *Server) JoinAsGuestHandler(w http.ResponseWriter, r *http.Request, sessionID string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req models.JoinAsGuestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxGuestNameLength {
+		http.Error(w, fmt.Sprintf("A name of 1 to %d characters is required", maxGuestNameLength), http.StatusBadRequest)
+		return
+	}
+	invite, ok := s.checkInvite(req.Invite, sessionID)
+	if !ok {
+		http.Error(w, "Invalid or revoked invite", http.StatusUnauthorized)
+		return
+	}
+
+	// Guests have no account; the ID only tells them apart in the session.
+	guestID := "guest:" + uuid.New().String()
+	token, err := auth.GenerateGuestToken(guestID, name, sessionID, invite.ID)
 	if err != nil {
-		resp.Error = err.Error()
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
+	resp := models.JoinAsGuestResponse{
+		AuthResponse: models.AuthResponse{
+			Token:    token,
+			UserID:   guestID,
+			Username: name,
+		},
+		SessionID: sessionID,
+		Role:      invite.Role,
+	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(resp)
 }
 
+// joinSession identifies the caller of GET /sessions/{id}, over HTTP or
+// WebSocket, and checks that their role allows action. A user opening an
+// invite to the session (?invite=...) becomes a member with its role until
+// the invite is revoked. A user joining over WebSocket may claim a session
+// without an owner; see claimSession. Guests hold a token from JoinAsGuestHandler instead,
+// and have the role of their invite for as long as it can be used.
+func (s *Server) joinSession(w http.ResponseWriter, r *http.Request, sessionID, token, action string) (*auth.Claims, string, bool) {
+	var claims *auth.Claims
+	if token != "" {
+		var err error
+		if claims, err = s.validateToken(token); err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, "", false
+		}
+	}
+
+	var role string
+	inviteToken := r.URL.Query().Get("invite")
+	switch {
+	case claims != nil && claims.Guest:
+		if claims.SessionID != sessionID {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return nil, "", false
+		}
+		invite, ok := s.Store.GetInvite(sessionID, claims.InviteID)
+		if !ok {
+			http.Error(w, "Invalid or revoked invite", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		role = invite.Role
+
+	case inviteToken == "":
+		if claims == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		if websocket.IsWebSocketUpgrade(r) && !s.claimSession(w, sessionID, claims) {
+			return nil, "", false
+		}
+		role, ok := s.authorize(w, sessionID, claims, action)
+		return claims, role, ok
+
+	default:
+		invite, ok := s.checkInvite(inviteToken, sessionID)
+		if !ok {
+			http.Error(w, "Invalid or revoked invite", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		if claims == nil {
+			// Guests pick a name first, at POST /sessions/{id}/guests.
+			http.Error(w, "A guest token is required to join with an invite", http.StatusUnauthorized)
+			return nil, "", false
+		}
+		if role, ok = s.Store.Role(sessionID, claims.UserID); !ok {
+			role = invite.Role
+			member := models.SessionMember{UserID: claims.UserID, UserName: claims.Username, Role: role, InviteID: invite.ID}
+			if err := s.Store.SetMember(sessionID, member); err != nil {
+				http.Error(w, "Internal server error", http.StatusInternalServerError)
+				return nil, "", false
+			}
+		}
+	}
+	if !session.Can(role, action) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return nil, "", false
+	}
+	return claims, role, true
+}
+
+// claimSession makes a user joining a session created before sessions had
+// owners its owner, if they ran code in it and nobody claimed it first. It
+// reports false if it answered with an error.
+func (s *Server) claimSession(w http.ResponseWriter, sessionID string, claims *auth.Claims) bool {
+	if claims.Guest || !s.Store.Ran(sessionID, claims.UserID) {
+		return true
+	}
+	claimed, err := s.Store.ClaimSession(sessionID, models.SessionMember{UserID: claims.UserID, UserName: claims.Username})
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if claimed {
+		log.Printf("Session %s claimed by %s", sessionID, claims.UserID)
+	}
+	return true
+}
+
+// checkInvite returns the invite a token stands for, if it is to the session
+// and can still be used.
+func (s *Server) checkInvite(token, sessionID string) (*models.Invite, bool) {
+	claims, err := auth.ValidateInviteToken(token)
+	if err != nil || claims.SessionID != sessionID {
+		return nil, false
+	}
+	return s.Store.GetInvite(sessionID, claims.ID)
+}
+
+// authorize checks that the caller's role in a session allows action, and
+// returns the role. If not, it answers 404 if there is no such session and
+// 403 otherwise.
+func (s *Server) authorize(w http.ResponseWriter, sessionID string, claims *auth.Claims, action string) (string, bool) {
+	role, ok := s.Store.Role(sessionID, claims.UserID)
+	if ok && session.Can(role, action) {
+		return role, true
+	}
+	if _, exists := s.Store.GetSession(sessionID); !exists {
+		http.Error(w, "Session not found", http.StatusNotFound)
+	} else {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+	return "", false
+}
+
 // Middleware for CORS
 func CORSMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -9,18 +9,28 @@ func (s *Server) SetupRoutes() *http.ServeMux {
 	// Public Routes
 	mux.HandleFunc("/register", s.RegisterHandler)
 	mux.HandleFunc("/login", s.LoginHandler)
+	mux.HandleFunc("/languages", s.ListLanguagesHandler)
+	mux.HandleFunc("/token/refresh", s.RefreshTokenHandler)
+	mux.HandleFunc("/.well-known/jwks.json", s.JWKSHandler)
 
 	// Protected Routes
+	// POST /logout -> Protected
+	mux.HandleFunc("/logout", s.AuthMiddleware(s.LogoutHandler))
+
 	// POST /sessions -> Protected
 	mux.HandleFunc("/sessions", s.AuthMiddleware(s.CreateSessionHandler))
 
 	// GET /sessions/{id} -> contains WS logic which does its own check.
 	// We rely on the handler's internal check for "token" param during WS upgrade,
-	// and if standard GET, we allow it (or should protect it? For now, allowing as per implementation).
+	// and protect the rest (/sessions/{id}, /runs, /members) in the handler,
+	// which also checks the caller's role in the session.
 	mux.HandleFunc("/sessions/", s.GetSessionHandler)
 
 	// POST /execute -> Protected
 	mux.HandleFunc("/execute", s.AuthMiddleware(s.ExecuteCodeHandler))
 
+	// POST /execute/tests -> Protected
+	mux.HandleFunc("/execute/tests", s.AuthMiddleware(s.ExecuteTestsHandler))
+
 	return mux
 }
@@ -13,6 +13,6 @@ func SetupTestDB() {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	d.AutoMigrate(&models.User{}, &models.Session{})
+	d.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.Session{}, &models.SessionFile{}, &models.SessionMember{}, &models.Invite{}, &models.Run{}, &models.BackplaneMessage{})
 	db.DB = d
 }
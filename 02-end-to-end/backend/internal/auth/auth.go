@@ -1,18 +1,40 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte("secret_key_change_me_in_prod")
+// inviteAudience sets invite tokens apart from the tokens of users.
+const inviteAudience = "invite"
+
+// AccessTokenExpiry is how long a user's token lasts. Users keep signed in
+// by trading their refresh token for a new one.
+const AccessTokenExpiry = 15 * time.Minute
+
+// guestTokenExpiry is how long a guest's token lasts: long enough for an
+// interview.
+const guestTokenExpiry = 4 * time.Hour
 
 type Claims struct {
 	UserID   string `json:"userId"`
 	Username string `json:"username"`
+
+	// Guest is set for someone who joined a session with an invite and a
+	// name of their choosing instead of an account. A guest can only join
+	// SessionID, and only while InviteID can still be used.
+	Guest     bool   `json:"guest,omitempty"`
+	SessionID string `json:"sessionId,omitempty"`
+	InviteID  string `json:"inviteId,omitempty"`
+
 	jwt.RegisteredClaims
 }
 
@@ -28,36 +50,112 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateToken creates a JWT for a user
+// GenerateToken creates a JWT for a user. Its ID lets it be revoked before
+// it expires.
 func GenerateToken(userID, username string) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+	expirationTime := time.Now().Add(AccessTokenExpiry)
 	claims := &Claims{
 		UserID:   userID,
 		Username: username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtKey)
+	return sign(claims)
+}
+
+// GenerateGuestToken creates a JWT for a guest of a session, who has no
+// account.
+func GenerateGuestToken(guestID, name, sessionID, inviteID string) (string, error) {
+	claims := &Claims{
+		UserID:    guestID,
+		Username:  name,
+		Guest:     true,
+		SessionID: sessionID,
+		InviteID:  inviteID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(guestTokenExpiry)),
+		},
+	}
+
+	return sign(claims)
 }
 
-// ValidateToken parses and validates a JWT
+// ValidateToken parses and validates a JWT. Tokens that never expire are
+// refused.
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	token, err := parse(tokenString, claims, jwt.WithExpirationRequired())
 
 	if err != nil {
 		return nil, err
 	}
 
-	if !token.Valid {
+	if !token.Valid || claims.UserID == "" {
 		return nil, errors.New("invalid token")
 	}
 
 	return claims, nil
 }
+
+// GenerateRefreshToken creates an opaque refresh token, and the hash it is
+// stored by.
+func GenerateRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the hash a refresh token is stored by.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// InviteClaims let whoever holds an invite join a session with a role. The
+// token's ID is the invite's, so it can be revoked.
+type InviteClaims struct {
+	SessionID string `json:"sessionId"`
+	Role      string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// GenerateInviteToken creates the token of an invite to a session.
+func GenerateInviteToken(inviteID, sessionID, role string, expiresAt time.Time) (string, error) {
+	claims := &InviteClaims{
+		SessionID: sessionID,
+		Role:      role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        inviteID,
+			Audience:  jwt.ClaimStrings{inviteAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	return sign(claims)
+}
+
+// ValidateInviteToken parses and validates the token of an invite. Whether
+// the invite was revoked is up to the caller.
+func ValidateInviteToken(tokenString string) (*InviteClaims, error) {
+	claims := &InviteClaims{}
+
+	token, err := parse(tokenString, claims, jwt.WithAudience(inviteAudience), jwt.WithExpirationRequired())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !token.Valid || claims.ID == "" || claims.SessionID == "" {
+		return nil, errors.New("invalid invite")
+	}
+
+	return claims, nil
+}
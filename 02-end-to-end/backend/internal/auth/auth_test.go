@@ -2,6 +2,7 @@ package auth
 
 import (
 	"testing"
+	"time"
 )
 
 func TestHashPassword(t *testing.T) {
@@ -49,6 +50,26 @@ func TestTokenGeneration(t *testing.T) {
 	if claims.Username != username {
 		t.Errorf("Expected username %s, got %s", username, claims.Username)
 	}
+
+	if claims.ID == "" {
+		t.Errorf("Expected the token to have an ID")
+	}
+	if claims.ExpiresAt.After(time.Now().Add(AccessTokenExpiry)) {
+		t.Errorf("Expected the token to expire within %v", AccessTokenExpiry)
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	token, hash, err := GenerateRefreshToken()
+	if err != nil {
+		t.Fatalf("GenerateRefreshToken failed: %v", err)
+	}
+	if token == hash || HashRefreshToken(token) != hash {
+		t.Errorf("Expected the token to be stored by its hash")
+	}
+	if other, _, _ := GenerateRefreshToken(); other == token {
+		t.Errorf("Expected refresh tokens to differ")
+	}
 }
 
 func TestInvalidToken(t *testing.T) {
@@ -58,6 +79,63 @@ func TestInvalidToken(t *testing.T) {
 	}
 }
 
+func TestInviteToken(t *testing.T) {
+	token, err := GenerateInviteToken("invite1", "session1", "candidate", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("GenerateInviteToken failed: %v", err)
+	}
+
+	claims, err := ValidateInviteToken(token)
+	if err != nil {
+		t.Fatalf("ValidateInviteToken failed: %v", err)
+	}
+	if claims.ID != "invite1" || claims.SessionID != "session1" || claims.Role != "candidate" {
+		t.Errorf("Unexpected invite claims %+v", claims)
+	}
+
+	// Invites and users' tokens can't stand in for each other.
+	if _, err := ValidateToken(token); err == nil {
+		t.Errorf("Expected an invite to be refused as a user's token")
+	}
+	userToken, _ := GenerateToken("user1", "testuser")
+	if _, err := ValidateInviteToken(userToken); err == nil {
+		t.Errorf("Expected a user's token to be refused as an invite")
+	}
+
+	expired, _ := GenerateInviteToken("invite2", "session1", "candidate", time.Now().Add(-time.Minute))
+	if _, err := ValidateInviteToken(expired); err == nil {
+		t.Errorf("Expected an expired invite to be refused")
+	}
+}
+
+func TestGuestToken(t *testing.T) {
+	token, err := GenerateGuestToken("guest:1", "Ada", "session1", "invite1")
+	if err != nil {
+		t.Fatalf("GenerateGuestToken failed: %v", err)
+	}
+
+	claims, err := ValidateToken(token)
+	if err != nil {
+		t.Fatalf("ValidateToken failed: %v", err)
+	}
+	if !claims.Guest || claims.Username != "Ada" || claims.SessionID != "session1" || claims.InviteID != "invite1" {
+		t.Errorf("Unexpected guest claims %+v", claims)
+	}
+	if claims.ExpiresAt.After(time.Now().Add(guestTokenExpiry)) {
+		t.Errorf("Expected a guest's token to expire within %v", guestTokenExpiry)
+	}
+}
+
+func TestTokenWithoutExpiry(t *testing.T) {
+	token, err := sign(&Claims{UserID: "user123", Username: "testuser"})
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	if _, err := ValidateToken(token); err == nil {
+		t.Error("Expected a token without an expiry to be refused")
+	}
+}
+
 func TestExpiredToken(t *testing.T) {
 	// Mock time or expiration?
 	// Since GenerateToken hardcodes 24h, hard to test expiration without modifying the function to accept time
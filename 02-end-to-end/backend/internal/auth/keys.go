@@ -0,0 +1,333 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// devSecret signs tokens when no key is configured. It is public, so only
+// fit for development.
+const devSecret = "secret_key_change_me_in_prod"
+
+// Key is a key tokens are signed or verified with. Keys of asymmetric
+// algorithms are told apart by their ID, the kid header of the tokens they
+// sign.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	// private signs tokens and is nil for keys that only verify them.
+	// public verifies them. For HS256 both are the secret.
+	private interface{}
+	public  interface{}
+}
+
+// KeySet is the key tokens are signed with and those they are verified with:
+// the signing key, and earlier ones kept while tokens they signed may still
+// be in use.
+type KeySet struct {
+	signing *Key
+	byID    map[string]*Key
+	// secret verifies tokens without a kid, signed with HS256.
+	secret *Key
+}
+
+var keys atomic.Pointer[KeySet]
+
+func init() {
+	ks, _ := NewKeySet(NewSecretKey([]byte(devSecret)))
+	keys.Store(ks)
+}
+
+// SetKeys makes ks the keys tokens are signed and verified with.
+func SetKeys(ks *KeySet) {
+	keys.Store(ks)
+}
+
+// NewSecretKey returns an HS256 key.
+func NewSecretKey(secret []byte) *Key {
+	return &Key{Method: jwt.SigningMethodHS256, private: secret, public: secret}
+}
+
+// NewKeySet returns a key set signing with signing and verifying with it and
+// the others.
+func NewKeySet(signing *Key, others ...*Key) (*KeySet, error) {
+	if signing == nil || signing.private == nil {
+		return nil, errors.New("the signing key must be a private key")
+	}
+	ks := &KeySet{signing: signing, byID: make(map[string]*Key)}
+	for _, key := range append([]*Key{signing}, others...) {
+		if key.ID == "" {
+			if ks.secret != nil {
+				return nil, errors.New("only one HS256 secret can be used")
+			}
+			ks.secret = key
+			continue
+		}
+		if _, ok := ks.byID[key.ID]; !ok {
+			ks.byID[key.ID] = key
+		}
+	}
+	return ks, nil
+}
+
+// KeysFromEnv loads the keys from the environment:
+//
+//   - JWT_SIGNING_KEY, or the file JWT_SIGNING_KEY_FILE, is the PEM private
+//     key tokens are signed with: RSA for RS256 or Ed25519 for EdDSA.
+//   - JWT_VERIFICATION_KEYS, or the file JWT_VERIFICATION_KEYS_FILE, holds
+//     the PEM public keys that signed tokens earlier, still accepted while
+//     keys are rotated.
+//   - JWT_SECRET is an HS256 secret. Tokens are signed with it if there is
+//     no signing key; otherwise, it only verifies tokens signed before.
+//
+// Without any, tokens are signed with a built-in secret, and the second
+// result is false.
+func KeysFromEnv() (*KeySet, bool, error) {
+	signingPEM, err := fromEnvOrFile("JWT_SIGNING_KEY")
+	if err != nil {
+		return nil, false, err
+	}
+	verificationPEM, err := fromEnvOrFile("JWT_VERIFICATION_KEYS")
+	if err != nil {
+		return nil, false, err
+	}
+	secret := os.Getenv("JWT_SECRET")
+
+	var others []*Key
+	if verificationPEM != nil {
+		if others, err = ParsePublicKeys(verificationPEM); err != nil {
+			return nil, false, fmt.Errorf("JWT_VERIFICATION_KEYS: %w", err)
+		}
+	}
+
+	var signing *Key
+	switch {
+	case signingPEM != nil:
+		if signing, err = ParsePrivateKey(signingPEM); err != nil {
+			return nil, false, fmt.Errorf("JWT_SIGNING_KEY: %w", err)
+		}
+		if secret != "" {
+			others = append(others, NewSecretKey([]byte(secret)))
+		}
+	case secret != "":
+		signing = NewSecretKey([]byte(secret))
+	default:
+		ks, err := NewKeySet(NewSecretKey([]byte(devSecret)), others...)
+		return ks, false, err
+	}
+
+	ks, err := NewKeySet(signing, others...)
+	return ks, true, err
+}
+
+// fromEnvOrFile returns the value of the environment variable name, or the
+// content of the file named by name_FILE, or nil if neither is set.
+func fromEnvOrFile(name string) ([]byte, error) {
+	if value := os.Getenv(name); value != "" {
+		return []byte(value), nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return data, nil
+}
+
+// ParsePrivateKey reads a PEM private key, RSA or Ed25519, in PKCS#8 or, for
+// RSA, PKCS#1.
+func ParsePrivateKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+
+	var private interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	key, err := newPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.private = private
+	return key, nil
+}
+
+// ParsePublicKeys reads one or more PEM public keys, RSA or Ed25519.
+func ParsePublicKeys(data []byte) ([]*Key, error) {
+	var keys []*Key
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var public interface{}
+		var err error
+		if block.Type == "RSA PUBLIC KEY" {
+			public, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		} else {
+			public, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, err
+		}
+		key, err := newPublicKey(public)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM key found")
+	}
+	return keys, nil
+}
+
+// newPublicKey returns the key that verifies tokens with public. Its ID is
+// the key's JWK thumbprint (RFC 7638), so the same key always has the same
+// ID.
+func newPublicKey(public interface{}) (*Key, error) {
+	key := &Key{public: public}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", public)
+	}
+
+	jwk := key.jwk()
+	var canonical []byte
+	switch jwk.Kty {
+	case "RSA":
+		canonical, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	case "OKP":
+		canonical, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	}
+	sum := sha256.Sum256(canonical)
+	key.ID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return key, nil
+}
+
+// JWK is a public key as published in a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+func (key *Key) jwk() JWK {
+	jwk := JWK{Kid: key.ID, Alg: key.Method.Alg(), Use: "sig"}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// JWKS returns the public keys tokens are verified with, the signing key
+// first, for other services to verify them too. HS256 secrets are never
+// published.
+func JWKS() []JWK {
+	ks := keys.Load()
+	jwks := []JWK{}
+	if ks.signing.ID != "" {
+		jwks = append(jwks, ks.signing.jwk())
+	}
+	ids := make([]string, 0, len(ks.byID))
+	for id := range ks.byID {
+		if id != ks.signing.ID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		jwks = append(jwks, ks.byID[id].jwk())
+	}
+	return jwks
+}
+
+// sign signs claims with the signing key.
+func sign(claims jwt.Claims) (string, error) {
+	key := keys.Load().signing
+	token := jwt.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	return token.SignedString(key.private)
+}
+
+// parse parses and verifies a token with the key its kid names, or the
+// HS256 secret if it has none. The token must use the key's algorithm.
+func parse(tokenString string, claims jwt.Claims, options ...jwt.ParserOption) (*jwt.Token, error) {
+	ks := keys.Load()
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		key := ks.secret
+		if kid, _ := token.Header["kid"].(string); kid != "" {
+			key = ks.byID[kid]
+		}
+		if key == nil {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+		}
+		return key.public, nil
+	}, options...)
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func rsaKeyPEM(t *testing.T) (private, public []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+func ed25519KeyPEM(t *testing.T) (private, public []byte) {
+	t.Helper()
+	pubKey, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, _ := x509.MarshalPKCS8PrivateKey(key)
+	pub, _ := x509.MarshalPKIXPublicKey(pubKey)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: priv}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+// useKeys signs and verifies tokens with ks for the rest of the test.
+func useKeys(t *testing.T, ks *KeySet) {
+	t.Helper()
+	previous := keys.Load()
+	SetKeys(ks)
+	t.Cleanup(func() { SetKeys(previous) })
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	rsaPrivate, _ := rsaKeyPEM(t)
+	edPrivate, _ := ed25519KeyPEM(t)
+
+	for _, tc := range []struct {
+		name string
+		pem  []byte
+		alg  string
+		kty  string
+	}{
+		{"RS256", rsaPrivate, "RS256", "RSA"},
+		{"EdDSA", edPrivate, "EdDSA", "OKP"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ParsePrivateKey(tc.pem)
+			if err != nil {
+				t.Fatalf("ParsePrivateKey failed: %v", err)
+			}
+			ks, _ := NewKeySet(key)
+			useKeys(t, ks)
+
+			token, err := GenerateToken("user1", "testuser")
+			if err != nil {
+				t.Fatalf("GenerateToken failed: %v", err)
+			}
+			if _, err := ValidateToken(token); err != nil {
+				t.Errorf("ValidateToken failed: %v", err)
+			}
+
+			jwks := JWKS()
+			if len(jwks) != 1 || jwks[0].Kid != key.ID || jwks[0].Alg != tc.alg || jwks[0].Kty != tc.kty {
+				t.Errorf("Unexpected JWKS %+v", jwks)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldPrivate, oldPublic := ed25519KeyPEM(t)
+	newPrivate, _ := rsaKeyPEM(t)
+
+	oldKey, _ := ParsePrivateKey(oldPrivate)
+	ks, _ := NewKeySet(oldKey)
+	useKeys(t, ks)
+	oldToken, _ := GenerateToken("user1", "testuser")
+	hsToken, _ := sign(&Claims{UserID: "user1"})
+
+	// The new key signs; the old one still verifies what it signed.
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "signing.pem"), newPrivate, 0o600)
+	t.Setenv("JWT_SIGNING_KEY_FILE", filepath.Join(dir, "signing.pem"))
+	t.Setenv("JWT_VERIFICATION_KEYS", string(oldPublic))
+	ks, configured, err := KeysFromEnv()
+	if err != nil || !configured {
+		t.Fatalf("KeysFromEnv failed: %v", err)
+	}
+	useKeys(t, ks)
+
+	newToken, _ := GenerateToken("user1", "testuser")
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := ValidateToken(token); err != nil {
+			t.Errorf("Expected the %s key's token to be valid: %v", name, err)
+		}
+	}
+	if jwks := JWKS(); len(jwks) != 2 || jwks[0].Alg != "RS256" || jwks[1].Kid != oldKey.ID {
+		t.Errorf("Expected the signing key, then the old one, got %+v", jwks)
+	}
+
+	// Once the old key is dropped, its tokens are refused.
+	t.Setenv("JWT_VERIFICATION_KEYS", "")
+	ks, _, _ = KeysFromEnv()
+	useKeys(t, ks)
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Errorf("Expected a token of a dropped key to be refused")
+	}
+	if _, err := ValidateToken(hsToken); err == nil {
+		t.Errorf("Expected a token without a kid to be refused without a secret")
+	}
+}
+
+func TestSecretKeys(t *testing.T) {
+	t.Setenv("JWT_SECRET", "a secret")
+	ks, configured, err := KeysFromEnv()
+	if err != nil || !configured {
+		t.Fatalf("KeysFromEnv failed: %v", err)
+	}
+	useKeys(t, ks)
+
+	token, _ := GenerateToken("user1", "testuser")
+	if _, err := ValidateToken(token); err != nil {
+		t.Errorf("ValidateToken failed: %v", err)
+	}
+	if jwks := JWKS(); len(jwks) != 0 {
+		t.Errorf("Expected the secret not to be published, got %+v", jwks)
+	}
+
+	// Tokens signed with another secret are refused.
+	t.Setenv("JWT_SECRET", "")
+	ks, configured, _ = KeysFromEnv()
+	if configured {
+		t.Errorf("Expected the built-in secret without configuration")
+	}
+	useKeys(t, ks)
+	if _, err := ValidateToken(token); err == nil {
+		t.Errorf("Expected a token of another secret to be refused")
+	}
+}
+
+func TestAlgorithmMustMatchKey(t *testing.T) {
+	private, public := rsaKeyPEM(t)
+	key, _ := ParsePrivateKey(private)
+	ks, _ := NewKeySet(key)
+	useKeys(t, ks)
+
+	// A token signed with HS256, using the public key as the secret, under
+	// the RSA key's kid.
+	forged := &Key{ID: key.ID, Method: NewSecretKey(nil).Method, private: public}
+	forgedKeys, _ := NewKeySet(forged)
+	SetKeys(forgedKeys)
+	token, _ := GenerateToken("user1", "testuser")
+	SetKeys(ks)
+
+	if _, err := ValidateToken(token); err == nil {
+		t.Errorf("Expected a token signed with another algorithm to be refused")
+	}
+}
@@ -15,8 +15,9 @@ import (
 
 var DB *gorm.DB
 
-func Init() {
-	dsn := fmt.Sprintf(
+// DSN builds the Postgres connection string from the DB_* environment variables.
+func DSN() string {
+	return fmt.Sprintf(
 		"host=%s user=%s password=%s dbname=%s port=%s sslmode=disable TimeZone=UTC",
 		os.Getenv("DB_HOST"),
 		os.Getenv("DB_USER"),
@@ -24,6 +25,10 @@ func Init() {
 		os.Getenv("DB_NAME"),
 		os.Getenv("DB_PORT"),
 	)
+}
+
+func Init() {
+	dsn := DSN()
 
 	// Retry logic for docker-compose startup
 	var err error
@@ -46,7 +51,7 @@ func Init() {
 
 	// Migrate schema
 	log.Println("Running migrations...")
-	err = DB.AutoMigrate(&models.User{}, &models.Session{})
+	err = DB.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.Session{}, &models.SessionFile{}, &models.SessionMember{}, &models.Invite{}, &models.Run{}, &models.BackplaneMessage{})
 	if err != nil {
 		log.Fatalf("Migration failed: %v", err)
 	}
@@ -1,94 +1,408 @@
 package executor
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path"
+	"strings"
+	"time"
+
+	"backend/internal/languages"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
 )
 
-// Executor defines the interface for running code
+// sandboxDir is where the guest sees the directory holding the program.
+const sandboxDir = "/sandbox"
+
+// Result is what a program produced when it ran.
+type Result struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+
+	// LimitExceeded names the limit that stopped the program, if any:
+	// LimitTime, LimitMemory, LimitCalls or LimitOutput.
+	LimitExceeded string
+}
+
+// Request is a program to run.
+type Request struct {
+	// Code is the program's entrypoint, the file that is run.
+	Code string
+
+	// Entrypoint is the path of the entrypoint, relative to the program's
+	// directory. Each executor has a default.
+	Entrypoint string
+
+	// Files are the program's other files by path, e.g. modules the
+	// entrypoint imports. They are written next to it.
+	Files map[string]string
+
+	// Stdin is the program's standard input.
+	Stdin string
+
+	// Args are the program's arguments.
+	Args []string
+
+	// Stdout and Stderr, if set, receive the program's output as it is
+	// written, in addition to the Result.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Owner is who the run is for, e.g. a user ID. Engine.Execute takes
+	// turns between owners when runs have to wait for a worker.
+	Owner string
+
+	// Timeout, if set, bounds the run once Engine.Execute has found it a
+	// worker. Time spent waiting for one doesn't count.
+	Timeout time.Duration
+
+	// Queued, if set, is called with the run's position in the queue while
+	// it waits for a worker, 1 being next, whenever the position changes.
+	Queued func(position int)
+}
+
+// Executor defines the interface for running code. An error means the code
+// could not be run; a program that ran and failed, or was stopped by a
+// limit, reports it through the Result.
 type Executor interface {
-	Run(ctx context.Context, code string) (string, error)
+	Run(ctx context.Context, req *Request) (*Result, error)
 }
 
 // Engine manages different language executors
 type Engine struct {
 	runtimes map[string]Executor
+	// languages lists the keys of runtimes in the order they were added.
+	languages []string
+
+	// pool bounds how many runs execute at once.
+	pool *scheduler
+
+	// wasm runs the language runtimes, whose compiled code is cached.
+	// Compiled Go programs run in goWasm, which has no cache: each program
+	// is different and caching them would only fill the cache up.
+	wasm   wazero.Runtime
+	goWasm wazero.Runtime
 }
 
+// EngineConfig sets up an Engine.
+type EngineConfig struct {
+	Pool PoolConfig
+
+	// Languages are the languages to run, the built-in ones if nil.
+	Languages *languages.Registry
+
+	// Remote lists the languages run by the runner listening on
+	// RunnerSocket rather than in process. "*" stands for all of them.
+	Remote       []string
+	RunnerSocket string
+}
+
+// EngineConfigFromEnv reads the pool size with PoolConfigFromEnv, and the
+// runner's socket and the languages it runs from EXEC_RUNNER_SOCKET and the
+// comma-separated EXEC_REMOTE_LANGUAGES. Without a socket, every language
+// runs in process.
+func EngineConfigFromEnv() EngineConfig {
+	config := EngineConfig{
+		Pool:         PoolConfigFromEnv(),
+		RunnerSocket: os.Getenv("EXEC_RUNNER_SOCKET"),
+	}
+	if config.RunnerSocket != "" {
+		for _, language := range strings.Split(os.Getenv("EXEC_REMOTE_LANGUAGES"), ",") {
+			if language = strings.TrimSpace(language); language != "" {
+				config.Remote = append(config.Remote, language)
+			}
+		}
+	}
+	return config
+}
+
+// isRemote reports whether language is run by the runner.
+func (c EngineConfig) isRemote(language string) bool {
+	for _, remote := range c.Remote {
+		if remote == language || remote == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEngine returns an Engine configured by EngineConfigFromEnv.
 func NewEngine() *Engine {
-	return &Engine{
-		runtimes: map[string]Executor{
-			"javascript": &WasmExecutor{BinaryPath: "wasm/quickjs.wasm", Name: "javascript"},
-			"python":     &WasmExecutor{BinaryPath: "wasm/python.wasm", Name: "python"}, // Placeholder
-			"go":         &MockGoExecutor{},                                             // Placeholder for now
-		},
+	return NewEngineWithConfig(EngineConfigFromEnv())
+}
+
+// NewEngineWithConfig sets up the languages of config.Languages, compiling
+// the runtimes run in process once, so each execution only has to
+// instantiate them. Compiled code is also kept in WASM_CACHE_DIR if set,
+// which lets restarts skip compiling.
+func NewEngineWithConfig(config EngineConfig) *Engine {
+	ctx := context.Background()
+
+	var cache wazero.CompilationCache
+	if dir := os.Getenv("WASM_CACHE_DIR"); dir != "" {
+		var err error
+		if cache, err = wazero.NewCompilationCacheWithDir(dir); err != nil {
+			log.Printf("Could not use WASM cache directory %s: %v", dir, err)
+		}
+	}
+	if cache == nil {
+		cache = wazero.NewCompilationCache()
+	}
+	wasm := NewRuntime(ctx, cache)
+	goWasm := NewRuntime(ctx, nil)
+
+	registry := config.Languages
+	if registry == nil {
+		registry = languages.Default()
+	}
+	e := &Engine{
+		runtimes: make(map[string]Executor),
+		pool:     newScheduler(config.Pool),
+		wasm:     wasm,
+		goWasm:   goWasm,
+	}
+	for _, lang := range registry.All() {
+		if config.isRemote(lang.ID) {
+			e.Register(lang.ID, &RemoteExecutor{Socket: config.RunnerSocket, Language: lang.ID})
+			continue
+		}
+
+		limits := DefaultLimits
+		if l := lang.Executor.Limits; l != nil {
+			limits = Limits{MemoryPages: l.MemoryPages, MaxCalls: l.MaxCalls, MaxOutput: l.MaxOutput}
+		}
+		switch lang.Executor.Type {
+		case languages.ExecutorGo:
+			e.Register(lang.ID, &GoExecutor{Runtime: goWasm, Limits: limits})
+		case languages.ExecutorWasm:
+			w := &WasmExecutor{
+				BinaryPath: lang.Executor.Binary,
+				Name:       lang.ID,
+				ScriptName: lang.Executor.ScriptName,
+				Args:       lang.Executor.Args,
+				Mounts:     lang.Executor.Mounts,
+				Env:        lang.Executor.Env,
+				Limits:     limits,
+			}
+			if err := w.Compile(ctx, wasm); err != nil {
+				log.Printf("%s is unavailable: %v", w.Name, err)
+			}
+			e.Register(lang.ID, w)
+		}
+	}
+	return e
+}
+
+// NewRuntime returns a runtime for WASI programs. Modules compiled in it are
+// kept in cache, which may be shared with other runtimes. A module running in
+// it is stopped when the context it was started with is done.
+func NewRuntime(ctx context.Context, cache wazero.CompilationCache) wazero.Runtime {
+	config := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if cache != nil {
+		config = config.WithCompilationCache(cache)
+	}
+	r := wazero.NewRuntimeWithConfig(ctx, config)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	return r
+}
+
+// Register sets the executor used for a language, replacing any existing one.
+func (e *Engine) Register(language string, runner Executor) {
+	if _, ok := e.runtimes[language]; !ok {
+		e.languages = append(e.languages, language)
 	}
+	e.runtimes[language] = runner
+}
+
+// Supports reports whether the engine can run language.
+func (e *Engine) Supports(language string) bool {
+	_, ok := e.runtimes[language]
+	return ok
 }
 
-func (e *Engine) Execute(ctx context.Context, code, language string) (string, error) {
+// Languages returns the languages the engine can run, in the order they
+// were registered.
+func (e *Engine) Languages() []string {
+	return append([]string(nil), e.languages...)
+}
+
+// Execute runs req in language once a worker is free. If the queue of runs
+// waiting for one is full, it returns a BusyError. Languages run by the
+// runner wait for one of the runner's workers instead.
+func (e *Engine) Execute(ctx context.Context, language string, req *Request) (*Result, error) {
 	runner, ok := e.runtimes[language]
 	if !ok {
-		return "", fmt.Errorf("unsupported language: %s", language)
+		return nil, fmt.Errorf("unsupported language: %s", language)
+	}
+
+	// The runner has a queue of its own; waiting here as well would hold one
+	// of this engine's workers for as long as the run lasts there.
+	if remote, ok := runner.(*RemoteExecutor); ok {
+		return remote.Run(ctx, req)
+	}
+
+	if err := e.pool.acquire(ctx, req.Owner, req.Queued); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() { e.pool.release(time.Since(start)) }()
+
+	if req.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+		defer cancel()
 	}
-	return runner.Run(ctx, code)
+	return runner.Run(ctx, req)
 }
 
-// WasmExecutor runs code using a WASM binary (e.g. QuickJS)
+// Close releases the compiled runtimes.
+func (e *Engine) Close(ctx context.Context) error {
+	return errors.Join(e.wasm.Close(ctx), e.goWasm.Close(ctx))
+}
+
+// WasmExecutor runs code using a WASI binary (e.g. QuickJS or CPython). The
+// binary is compiled once by Compile, and each Run gets a fresh instance.
 type WasmExecutor struct {
 	BinaryPath string
 	Name       string
-}
 
-func (w *WasmExecutor) Run(ctx context.Context, code string) (string, error) {
-	// Check if binary exists
-	if _, err := os.Stat(w.BinaryPath); os.IsNotExist(err) {
-		return fmt.Sprintf("Mock Output for %s:\n%s\n(WASM binary not found at %s)", w.Name, code, w.BinaryPath), nil
-	}
+	// ScriptName is the file the code is written to unless the request
+	// names an entrypoint, "main" if empty. The program's files are placed
+	// in a read-only directory mounted at /sandbox, and the entrypoint's
+	// guest path is passed to the interpreter ahead of the program's own
+	// arguments.
+	ScriptName string
 
-	// Initialize wazero runtime
-	r := wazero.NewRuntime(ctx)
-	defer r.Close(ctx)
+	// Args are interpreter flags, passed before the script path.
+	Args []string
 
-	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	// Mounts maps host directories to guest paths, e.g. a standard library.
+	// They are mounted read-only.
+	Mounts map[string]string
+
+	// Env is the guest's environment.
+	Env map[string]string
 
-	// Load binary
+	// Limits bound each run. They must be set before Compile.
+	Limits Limits
+
+	// Set by Compile.
+	runtime    wazero.Runtime
+	module     wazero.CompiledModule
+	compileErr error
+}
+
+// Compile loads the binary and compiles it in r, which must have been
+// created by NewRuntime. It must be called before Run; if it fails, Run
+// reports the error.
+func (w *WasmExecutor) Compile(ctx context.Context, r wazero.Runtime) error {
 	wasmBytes, err := os.ReadFile(w.BinaryPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to read wasm binary: %w", err)
+		w.compileErr = fmt.Errorf("%s runtime is not installed: %w", w.Name, err)
+		return w.compileErr
 	}
+	if w.Limits.MaxCalls > 0 {
+		ctx = withCallCounting(ctx)
+	}
+	module, err := r.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		w.compileErr = fmt.Errorf("failed to compile %s runtime: %w", w.Name, err)
+		return w.compileErr
+	}
+	w.runtime, w.module, w.compileErr = r, module, nil
+	return nil
+}
 
-	// Capture stdout/stderr
-	var stdout, stderr bytes.Buffer
-
-	// QuickJS/Python WASM usually take code as an argument or stdin
-	// Here we assume stdin for simplicity or a specific argument pattern
-	// For QuickJS standalone, usually `qjs -e 'code'` or stdin.
-
-	config := wazero.NewModuleConfig().
-		WithStdout(&stdout).
-		WithStderr(&stderr).
-		WithStdin(bytes.NewBufferString(code)) // Feed code to stdin
+func (w *WasmExecutor) Run(ctx context.Context, req *Request) (*Result, error) {
+	if w.module == nil {
+		if w.compileErr != nil {
+			return nil, w.compileErr
+		}
+		return nil, fmt.Errorf("%s runtime is not compiled", w.Name)
+	}
 
-		// Enforce limits? wazero supports it with ctx, or memory limits
-		// .WithMemoryLimitPages(256) (16MB)
+	scriptName := w.ScriptName
+	if scriptName == "" {
+		scriptName = "main"
+	}
+	dir, err := os.MkdirTemp("", "exec-"+w.Name+"-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox: %w", err)
+	}
+	defer os.RemoveAll(dir)
 
-	_, err = r.InstantiateWithConfig(ctx, wasmBytes, config)
+	entrypoint, err := writeProgram(dir, req, scriptName)
 	if err != nil {
-		return stderr.String(), fmt.Errorf("runtime error: %w", err)
+		return nil, err
+	}
+
+	fsConfig := wazero.NewFSConfig().WithReadOnlyDirMount(dir, sandboxDir)
+	for host, guest := range w.Mounts {
+		fsConfig = fsConfig.WithReadOnlyDirMount(host, guest)
 	}
 
-	return stdout.String(), nil
+	args := append([]string{w.Name}, w.Args...)
+	args = append(args, path.Join(sandboxDir, entrypoint))
+	args = append(args, req.Args...)
+
+	config := wazero.NewModuleConfig().WithArgs(args...).WithFSConfig(fsConfig)
+	for key, value := range w.Env {
+		config = config.WithEnv(key, value)
+	}
+	return instantiate(ctx, w.runtime, w.module, config, w.Limits, req)
 }
 
-// MockGoExecutor simulates Go execution since compiling Go to WASM on the fly is heavy
-type MockGoExecutor struct{}
+// instantiate runs a compiled WASI program to completion, or until it hits
+// one of its limits.
+func instantiate(ctx context.Context, r wazero.Runtime, module wazero.CompiledModule, config wazero.ModuleConfig, limits Limits, req *Request) (*Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	l := newLimiter(limits, cancel)
+
+	// Capture stdout/stderr
+	stdout := &limitedWriter{limiter: l, max: limits.MaxOutput, stream: req.Stdout}
+	stderr := &limitedWriter{limiter: l, max: limits.MaxOutput, stream: req.Stderr}
+
+	// An empty name lets the same module be instantiated by concurrent runs.
+	config = config.
+		WithName("").
+		WithStdin(strings.NewReader(req.Stdin)).
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithSysWalltime().
+		WithSysNanotime()
 
-func (m *MockGoExecutor) Run(ctx context.Context, code string) (string, error) {
-	// In a real generic executor, we'd run `go run` or compile to WASM
-	return fmt.Sprintf("Mock Go Output:\nRun: %s\n(Server-side compilation mocked)", code), nil
+	mod, err := r.InstantiateModule(l.withContext(ctx), module, config)
+	if mod != nil {
+		defer mod.Close(ctx)
+	}
+
+	result := &Result{Stdout: stdout.String(), Stderr: stderr.String()}
+	if limit := l.exceededLimit(); limit != "" {
+		result.LimitExceeded = limit
+		return result, nil
+	}
+	if err != nil {
+		var exitErr *sys.ExitError
+		if !errors.As(err, &exitErr) {
+			return result, fmt.Errorf("runtime error: %w", err)
+		}
+		switch exitErr.ExitCode() {
+		case sys.ExitCodeDeadlineExceeded:
+			result.LimitExceeded = LimitTime
+		case sys.ExitCodeContextCanceled:
+			return result, context.Canceled
+		default:
+			result.ExitCode = int(exitErr.ExitCode())
+		}
+	}
+	return result, nil
 }
@@ -0,0 +1,414 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+var (
+	guestOnce sync.Once
+	guestDir  string
+	guestPath string
+	guestErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if guestDir != "" {
+		os.RemoveAll(guestDir)
+	}
+	os.Exit(code)
+}
+
+// buildGuest compiles testdata/guest for WASI once and returns the binary's
+// path.
+func buildGuest(t *testing.T) string {
+	t.Helper()
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	guestOnce.Do(func() {
+		guestDir, guestErr = os.MkdirTemp("", "guest-")
+		if guestErr != nil {
+			return
+		}
+		guestPath = filepath.Join(guestDir, "guest.wasm")
+		cmd := exec.Command(goBin, "build", "-o", guestPath, "./testdata/guest")
+		cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			guestErr = fmt.Errorf("build guest: %v\n%s", err, output)
+		}
+	})
+	if guestErr != nil {
+		t.Fatal(guestErr)
+	}
+	return guestPath
+}
+
+// testCache is shared by the tests' runtimes, so the guest is compiled once.
+var testCache = wazero.NewCompilationCache()
+
+func newTestRuntime(t *testing.T) wazero.Runtime {
+	t.Helper()
+	r := NewRuntime(context.Background(), testCache)
+	t.Cleanup(func() { r.Close(context.Background()) })
+	return r
+}
+
+// compileGuest returns w compiled in a fresh runtime.
+func compileGuest(t *testing.T, w *WasmExecutor) *WasmExecutor {
+	t.Helper()
+	if err := w.Compile(context.Background(), newTestRuntime(t)); err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+	return w
+}
+
+func TestWasmExecutorRunsScriptFile(t *testing.T) {
+	binary := buildGuest(t)
+
+	lib := t.TempDir()
+	if err := os.WriteFile(filepath.Join(lib, "lib.txt"), []byte("stdlib\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	w := compileGuest(t, &WasmExecutor{
+		BinaryPath: binary,
+		Name:       "guest",
+		ScriptName: "main.py",
+		Mounts:     map[string]string{lib: "/usr/local/lib"},
+		Env:        map[string]string{"GUEST_ENV": "set"},
+	})
+
+	result, err := w.Run(context.Background(), &Request{Code: "print('hi')\n"})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "print('hi')\n" {
+		t.Errorf("Stdout = %q", result.Stdout)
+	}
+	if !strings.Contains(result.Stderr, "lib: stdlib") {
+		t.Errorf("mounted library not readable, stderr = %q", result.Stderr)
+	}
+	if strings.Contains(result.Stderr, "sandbox is writable") {
+		t.Errorf("script directory should be read-only")
+	}
+	if !strings.Contains(result.Stderr, "env: set") {
+		t.Errorf("environment not passed, stderr = %q", result.Stderr)
+	}
+	if result.ExitCode != 0 {
+		t.Errorf("ExitCode = %d, want 0", result.ExitCode)
+	}
+}
+
+func TestWasmExecutorExitCode(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest"})
+
+	result, err := w.Run(context.Background(), &Request{Code: "exit 3\n"})
+	if err != nil {
+		t.Fatalf("a failing program is not an execution error: %v", err)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("ExitCode = %d, want 3", result.ExitCode)
+	}
+	if result.Stdout != "exit 3\n" {
+		t.Errorf("Stdout = %q", result.Stdout)
+	}
+}
+
+func TestWasmExecutorStdinAndArgs(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest"})
+
+	result, err := w.Run(context.Background(), &Request{
+		Code:  "stdin\n",
+		Stdin: "1 2 3\n",
+		Args:  []string{"-n", "two words"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "stdin\n1 2 3\n" {
+		t.Errorf("stdin not passed to the program, Stdout = %q", result.Stdout)
+	}
+	if !strings.Contains(result.Stderr, `args: ["-n" "two words"]`) {
+		t.Errorf("arguments not passed after the script, Stderr = %q", result.Stderr)
+	}
+}
+
+func TestWasmExecutorFiles(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest", ScriptName: "main.py"})
+
+	result, err := w.Run(context.Background(), &Request{
+		Code:       "cat /sandbox/lib/utils.py\n",
+		Entrypoint: "app/run.py",
+		Files:      map[string]string{"lib/utils.py": "def helper(): pass\n"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "cat /sandbox/lib/utils.py\ndef helper(): pass\n" || result.ExitCode != 0 {
+		t.Errorf("got %+v, want the entrypoint and the file it read", result)
+	}
+
+	for _, p := range []string{"../escape.py", "/etc/passwd", "a//b.py", "."} {
+		if _, err := w.Run(context.Background(), &Request{Code: "exit 0\n", Files: map[string]string{p: ""}}); err == nil {
+			t.Errorf("expected %q to be refused", p)
+		}
+	}
+}
+
+func TestWasmExecutorReusesCompiledModule(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest"})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code := fmt.Sprintf("run %d\n", i)
+			result, err := w.Run(context.Background(), &Request{Code: code})
+			if err != nil {
+				errs <- err
+				return
+			}
+			if result.Stdout != code {
+				errs <- fmt.Errorf("run %d printed %q", i, result.Stdout)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCompilationCacheDir(t *testing.T) {
+	binary := buildGuest(t)
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	cache, err := wazero.NewCompilationCacheWithDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRuntime(ctx, cache)
+	defer r.Close(ctx)
+
+	w := &WasmExecutor{BinaryPath: binary, Name: "guest"}
+	if err := w.Compile(ctx, r); err != nil {
+		t.Fatalf("Compile failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("compiled module was not written to the cache directory")
+	}
+}
+
+func TestWasmExecutorTimeout(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	result, err := w.Run(ctx, &Request{Code: "loop\n"})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.LimitExceeded != LimitTime {
+		t.Errorf("LimitExceeded = %q, want %q", result.LimitExceeded, LimitTime)
+	}
+}
+
+func TestWasmExecutorLimits(t *testing.T) {
+	binary := buildGuest(t)
+
+	tests := []struct {
+		code   string
+		limits Limits
+		want   string
+	}{
+		{"alloc\n", Limits{MemoryPages: 1024}, LimitMemory},
+		{"calls\n", Limits{MaxCalls: 1_000_000}, LimitCalls},
+		{"spam\n", Limits{MaxOutput: 1000}, LimitOutput},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			w := compileGuest(t, &WasmExecutor{BinaryPath: binary, Name: "guest", Limits: tt.limits})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			result, err := w.Run(ctx, &Request{Code: tt.code})
+			if err != nil {
+				t.Fatalf("Run failed: %v", err)
+			}
+			if result.LimitExceeded != tt.want {
+				t.Errorf("LimitExceeded = %q, want %q", result.LimitExceeded, tt.want)
+			}
+		})
+	}
+}
+
+func TestWasmExecutorTruncatesOutput(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest", Limits: Limits{MaxOutput: 100}})
+
+	result, err := w.Run(context.Background(), &Request{Code: "spam\n"})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	kept, marker, ok := strings.Cut(result.Stdout, "\n... output truncated at 100 bytes")
+	if !ok || marker != "" {
+		t.Fatalf("Stdout = %q, want a truncation marker at the end", result.Stdout)
+	}
+	if len(kept) != 100 {
+		t.Errorf("kept %d bytes, want 100", len(kept))
+	}
+}
+
+func TestOutputTruncatedBetweenCharacters(t *testing.T) {
+	w := &limitedWriter{limiter: newLimiter(Limits{}, func() {}), max: 4}
+
+	// The limit falls in the middle of "é".
+	w.Write([]byte("caf\u00e9!"))
+	kept, _, _ := strings.Cut(w.String(), "\n...")
+	if kept != "caf" {
+		t.Errorf("kept %q, want %q", kept, "caf")
+	}
+}
+
+func TestWasmExecutorWithinLimits(t *testing.T) {
+	w := compileGuest(t, &WasmExecutor{BinaryPath: buildGuest(t), Name: "guest", Limits: DefaultLimits})
+
+	result, err := w.Run(context.Background(), &Request{Code: "exit 0\n"})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.LimitExceeded != "" || result.ExitCode != 0 {
+		t.Errorf("got %+v, want a clean exit", result)
+	}
+}
+
+func TestWasmExecutorMissingBinary(t *testing.T) {
+	w := &WasmExecutor{BinaryPath: filepath.Join(t.TempDir(), "missing.wasm"), Name: "python"}
+	if err := w.Compile(context.Background(), newTestRuntime(t)); err == nil {
+		t.Error("expected Compile to fail for a missing runtime")
+	}
+
+	if _, err := w.Run(context.Background(), &Request{Code: "print(1)"}); err == nil {
+		t.Error("expected an error for a missing runtime")
+	}
+}
+
+func TestGoExecutorRunsProgram(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	code := `package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+func main() {
+	name, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Printf("hello from go, %s", name)
+	fmt.Fprintln(os.Stderr, "warning:", os.Args[1:])
+	os.Exit(4)
+}
+`
+	result, err := (&GoExecutor{Runtime: newTestRuntime(t)}).Run(context.Background(), &Request{
+		Code:  code,
+		Stdin: "gopher\n",
+		Args:  []string{"-v"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "hello from go, gopher\n" || result.Stderr != "warning: [-v]\n" {
+		t.Errorf("got stdout %q, stderr %q", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 4 {
+		t.Errorf("ExitCode = %d, want 4", result.ExitCode)
+	}
+}
+
+func TestGoExecutorPackages(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	result, err := (&GoExecutor{Runtime: newTestRuntime(t)}).Run(context.Background(), &Request{
+		Code:       "package main\n\nimport \"main/greet\"\n\nfunc main() { greet.Hello(name) }\n",
+		Entrypoint: "cmd/hello/main.go",
+		Files: map[string]string{
+			"cmd/hello/name.go": "package main\n\nconst name = \"gopher\"\n",
+			"greet/greet.go":    "package greet\n\nimport \"fmt\"\n\nfunc Hello(name string) { fmt.Println(\"hello,\", name) }\n",
+			"go.mod":            "module evil\n",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "hello, gopher\n" {
+		t.Errorf("Stdout = %q", result.Stdout)
+	}
+}
+
+func TestGoExecutorCompileError(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not available")
+	}
+
+	code := "package main\n\nfunc main() {\n\tx := 1\n\tundefinedFunc()\n}\n"
+	_, err := (&GoExecutor{Runtime: newTestRuntime(t)}).Run(context.Background(), &Request{Code: code})
+
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) {
+		t.Fatalf("err = %v, want a CompileError", err)
+	}
+	if len(compileErr.Diagnostics) != 2 {
+		t.Fatalf("Diagnostics = %+v, want 2", compileErr.Diagnostics)
+	}
+	d := compileErr.Diagnostics[0]
+	if d.File != "main.go" || d.Line != 4 || d.Column != 2 || !strings.Contains(d.Message, "declared and not used") {
+		t.Errorf("Diagnostics[0] = %+v", d)
+	}
+	if d := compileErr.Diagnostics[1]; d.Line != 5 || !strings.Contains(d.Message, "undefined: undefinedFunc") {
+		t.Errorf("Diagnostics[1] = %+v", d)
+	}
+}
+
+func TestParseDiagnostics(t *testing.T) {
+	output := "# main\n./main.go:3:8: \"os\" imported and not used\n./main.go:7:2: too many errors\n\tmore detail\n"
+	got := parseDiagnostics(output)
+	if len(got) != 2 {
+		t.Fatalf("got %+v", got)
+	}
+	if got[0].File != "main.go" || got[0].Line != 3 || got[0].Column != 8 {
+		t.Errorf("got[0] = %+v", got[0])
+	}
+	if got[1].Message != "too many errors\nmore detail" {
+		t.Errorf("got[1].Message = %q", got[1].Message)
+	}
+}
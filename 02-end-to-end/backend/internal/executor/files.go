@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// MaxFiles bounds how many files a program may have.
+	MaxFiles = 50
+
+	// maxPathLength bounds the length of a file's path.
+	maxPathLength = 255
+)
+
+// ValidatePath checks that p can name one of a program's files: a relative,
+// slash-separated path without "." or ".." elements.
+func ValidatePath(p string) error {
+	if len(p) > maxPathLength {
+		return fmt.Errorf("path is longer than %d bytes: %q", maxPathLength, p)
+	}
+	if p == "." || !fs.ValidPath(p) {
+		return fmt.Errorf("invalid path: %q", p)
+	}
+	return nil
+}
+
+// ValidateFiles checks the files of a request: how many there are and their
+// paths, the entrypoint's included.
+func ValidateFiles(entrypoint string, files map[string]string) error {
+	if len(files) >= MaxFiles {
+		return fmt.Errorf("a program can have at most %d files", MaxFiles)
+	}
+	if entrypoint != "" {
+		if err := ValidatePath(entrypoint); err != nil {
+			return err
+		}
+	}
+	for p := range files {
+		if err := ValidatePath(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProgram writes the files of req into dir, and its code to its
+// entrypoint, or to defaultEntrypoint if it has none. It returns the path of
+// the entrypoint.
+func writeProgram(dir string, req *Request, defaultEntrypoint string) (string, error) {
+	entrypoint := req.Entrypoint
+	if entrypoint == "" {
+		entrypoint = defaultEntrypoint
+	}
+	if err := ValidateFiles(entrypoint, req.Files); err != nil {
+		return "", err
+	}
+
+	// The entrypoint goes last, so its code wins over a file of the same path.
+	for p, content := range req.Files {
+		if err := writeFile(dir, p, content); err != nil {
+			return "", err
+		}
+	}
+	if err := writeFile(dir, entrypoint, req.Code); err != nil {
+		return "", err
+	}
+	return entrypoint, nil
+}
+
+func writeFile(dir, p, content string) error {
+	name := filepath.Join(dir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p, err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", p, err)
+	}
+	return nil
+}
+
+// CodeHash identifies a program's source in run history without storing it.
+// The hash of a program with other files covers them too, by path.
+func CodeHash(code string, files map[string]string) string {
+	h := sha256.New()
+	h.Write([]byte(code))
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(h, "\x00%s\x00%s", p, files[p])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
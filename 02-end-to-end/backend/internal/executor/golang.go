@@ -0,0 +1,153 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"backend/internal/models"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// goModule is the go.mod the submitted program is built in. The program can
+// only use the standard library.
+const goModule = "module main\n\ngo 1.24\n"
+
+// CompileError is returned when a program does not compile. Runtime failures
+// are reported through Result.ExitCode instead.
+type CompileError struct {
+	Diagnostics []models.Diagnostic
+	// Output is the compiler's output as printed.
+	Output string
+}
+
+func (e *CompileError) Error() string {
+	return "compilation failed"
+}
+
+// GoExecutor compiles Go programs to WASI with the host's Go toolchain and
+// runs the result in the same sandbox as the other languages.
+type GoExecutor struct {
+	// GoBin is the go command; "go" from PATH if empty.
+	GoBin string
+
+	// Runtime runs the compiled programs. It must have been created by
+	// NewRuntime, preferably without a cache.
+	Runtime wazero.Runtime
+
+	// Limits bound each run. Building the program only counts against the
+	// time limit.
+	Limits Limits
+}
+
+func (g *GoExecutor) Run(ctx context.Context, req *Request) (*Result, error) {
+	goBin := g.GoBin
+	if goBin == "" {
+		goBin = "go"
+	}
+	goBin, err := exec.LookPath(goBin)
+	if err != nil {
+		return nil, fmt.Errorf("go runtime is not installed: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "exec-go-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The program's files go in src, and the binary next to it so that it
+	// can't clash with one of them.
+	src := filepath.Join(dir, "src")
+	entrypoint, err := writeProgram(src, req, "main.go")
+	if err != nil {
+		return nil, err
+	}
+	// The module is always ours, even if the program has a go.mod.
+	if err := os.WriteFile(filepath.Join(src, "go.mod"), []byte(goModule), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write go.mod: %w", err)
+	}
+
+	// The package built is the one the entrypoint is in.
+	binary := filepath.Join(dir, "main.wasm")
+	pkg := "./" + path.Dir(entrypoint)
+	build := exec.CommandContext(ctx, goBin, "build", "-o", binary, pkg)
+	build.Dir = src
+	// Nothing is downloaded: the program gets the standard library only.
+	build.Env = append(os.Environ(),
+		"GOOS=wasip1",
+		"GOARCH=wasm",
+		"CGO_ENABLED=0",
+		"GOPROXY=off",
+		"GOTOOLCHAIN=local",
+		"GOFLAGS=",
+		"GOWORK=off",
+	)
+	if output, err := build.CombinedOutput(); err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			return &Result{LimitExceeded: LimitTime}, nil
+		case ctx.Err() != nil:
+			return nil, ctx.Err()
+		}
+		diagnostics := parseDiagnostics(string(output))
+		if len(diagnostics) == 0 {
+			return nil, fmt.Errorf("go build failed: %v: %s", err, output)
+		}
+		return nil, &CompileError{Diagnostics: diagnostics, Output: string(output)}
+	}
+
+	wasmBytes, err := os.ReadFile(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read program: %w", err)
+	}
+	compileCtx := ctx
+	if g.Limits.MaxCalls > 0 {
+		compileCtx = withCallCounting(ctx)
+	}
+	module, err := g.Runtime.CompileModule(compileCtx, wasmBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile program: %w", err)
+	}
+	defer module.Close(ctx)
+
+	config := wazero.NewModuleConfig().WithArgs(append([]string{"main"}, req.Args...)...)
+	return instantiate(ctx, g.Runtime, module, config, g.Limits, req)
+}
+
+// diagnosticLine matches compiler output such as "./main.go:5:2: undefined: x".
+var diagnosticLine = regexp.MustCompile(`^(\S+\.go):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseDiagnostics extracts the errors reported by go build. Indented lines
+// continue the previous error's message.
+func parseDiagnostics(output string) []models.Diagnostic {
+	var diagnostics []models.Diagnostic
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := diagnosticLine.FindStringSubmatch(line); m != nil {
+			d := models.Diagnostic{
+				File:    strings.TrimPrefix(m[1], "./"),
+				Message: m[4],
+			}
+			d.Line, _ = strconv.Atoi(m[2])
+			d.Column, _ = strconv.Atoi(m[3])
+			diagnostics = append(diagnostics, d)
+			continue
+		}
+		if strings.HasPrefix(line, "\t") && len(diagnostics) > 0 {
+			last := &diagnostics[len(diagnostics)-1]
+			last.Message += "\n" + strings.TrimSpace(line)
+		}
+	}
+	return diagnostics
+}
@@ -0,0 +1,220 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Limits reported in Result.LimitExceeded.
+const (
+	LimitTime   = "time"
+	LimitMemory = "memory"
+	LimitCalls  = "calls"
+	LimitOutput = "output"
+)
+
+// pageSize is the size of a WebAssembly memory page.
+const pageSize = 64 * 1024
+
+// Limits bound what a single execution may use. A zero field means no limit.
+type Limits struct {
+	// MemoryPages caps the program's linear memory, in 64 KiB pages.
+	MemoryPages uint32
+
+	// MaxCalls caps the number of function calls the program makes, which
+	// stops runaway recursion and call-heavy code the same way however busy
+	// the server is. Every call is counted from Go, which makes calls
+	// several times slower. It is not a CPU budget: wazero can't meter
+	// instructions, so a loop that makes no calls is stopped only by the
+	// timeout, which is all that bounds CPU time.
+	MaxCalls uint64
+
+	// MaxOutput caps stdout and stderr, each, in bytes.
+	MaxOutput int
+}
+
+// DefaultLimits apply to the languages whose configuration sets no limits.
+// MaxCalls is left off for its cost.
+var DefaultLimits = Limits{
+	MemoryPages: 4096, // 256 MiB
+	MaxOutput:   1 << 20,
+}
+
+// limiter enforces the limits of one execution. The first limit hit stops
+// the program by cancelling its context.
+type limiter struct {
+	limits Limits
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	exceeded string
+
+	calls atomic.Uint64
+}
+
+func newLimiter(limits Limits, cancel context.CancelFunc) *limiter {
+	return &limiter{limits: limits, cancel: cancel}
+}
+
+func (l *limiter) exceed(limit string) {
+	l.mu.Lock()
+	if l.exceeded == "" {
+		l.exceeded = limit
+	}
+	l.mu.Unlock()
+	l.cancel()
+}
+
+// exceededLimit returns the limit that stopped the program, if any.
+func (l *limiter) exceededLimit() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+// withContext sets up ctx so that the program instantiated with it is held
+// to the limits.
+func (l *limiter) withContext(ctx context.Context) context.Context {
+	if l.limits.MemoryPages > 0 {
+		ctx = experimental.WithMemoryAllocator(ctx, l)
+	}
+	if l.limits.MaxCalls > 0 {
+		ctx = context.WithValue(ctx, limiterKey{}, l)
+	}
+	return ctx
+}
+
+// Allocate gives the program a linear memory that refuses to grow past the
+// memory limit.
+func (l *limiter) Allocate(capacity, max uint64) experimental.LinearMemory {
+	limit := uint64(l.limits.MemoryPages) * pageSize
+	if max > limit {
+		max = limit
+	}
+	if capacity > max {
+		capacity = max
+	}
+	return &limitedMemory{limiter: l, buf: make([]byte, 0, capacity), max: max}
+}
+
+// limitedMemory is a linear memory capped at max bytes.
+type limitedMemory struct {
+	limiter *limiter
+	buf     []byte
+	max     uint64
+}
+
+func (m *limitedMemory) Reallocate(size uint64) []byte {
+	if size > m.max {
+		m.limiter.exceed(LimitMemory)
+		if len(m.buf) > 0 {
+			return nil
+		}
+		// The initial allocation cannot be refused; the program is
+		// stopped before it runs instead.
+	}
+	if size <= uint64(cap(m.buf)) {
+		m.buf = m.buf[:size]
+		return m.buf
+	}
+
+	// Grow ahead of need, like append does, but not past the limit.
+	capacity := uint64(cap(m.buf)) * 2
+	if capacity < size {
+		capacity = size
+	}
+	if capacity > m.max && size <= m.max {
+		capacity = m.max
+	}
+	buf := make([]byte, size, capacity)
+	copy(buf, m.buf)
+	m.buf = buf
+	return m.buf
+}
+
+func (m *limitedMemory) Free() {
+	m.buf = nil
+}
+
+// limiterKey carries the limiter of an execution to the call counter.
+type limiterKey struct{}
+
+// callCounter counts every function call against MaxCalls. It is compiled
+// into modules that have a call limit, and finds the running execution's
+// limiter through the call's context.
+type callCounter struct{}
+
+// withCallCounting sets up ctx so that modules compiled with it count calls.
+func withCallCounting(ctx context.Context) context.Context {
+	return experimental.WithFunctionListenerFactory(ctx, callCounter{})
+}
+
+func (f callCounter) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return f
+}
+
+func (callCounter) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	l, ok := ctx.Value(limiterKey{}).(*limiter)
+	if ok && l.calls.Add(1) == l.limits.MaxCalls+1 {
+		l.exceed(LimitCalls)
+	}
+}
+
+func (callCounter) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (callCounter) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// limitedWriter keeps the first max bytes written to it, and passes them on
+// to stream if set. Writing more stops the program, and the output is marked
+// as truncated.
+type limitedWriter struct {
+	limiter   *limiter
+	max       int
+	stream    io.Writer
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.truncated {
+		return len(p), nil
+	}
+	if room := w.max - w.buf.Len(); w.max > 0 && len(p) > room {
+		// Don't keep half a character.
+		for room > 0 && !utf8.RuneStart(p[room]) {
+			room--
+		}
+		w.keep(p[:room])
+		w.keep([]byte(w.marker()))
+		w.truncated = true
+		w.limiter.exceed(LimitOutput)
+		return len(p), nil
+	}
+	w.keep(p)
+	return len(p), nil
+}
+
+func (w *limitedWriter) keep(p []byte) {
+	w.buf.Write(p)
+	if w.stream != nil {
+		// The program's output must not fail because a reader went away.
+		w.stream.Write(p)
+	}
+}
+
+func (w *limitedWriter) marker() string {
+	return fmt.Sprintf("\n... output truncated at %d bytes", w.max)
+}
+
+// String returns the output kept, with a marker if some was dropped.
+func (w *limitedWriter) String() string {
+	return w.buf.String()
+}
@@ -0,0 +1,246 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors wrapped in a BusyError when a run cannot be queued.
+var (
+	// ErrQueueFull means the server has as many runs waiting as it accepts.
+	ErrQueueFull = errors.New("execution queue is full")
+
+	// ErrTooManyQueued means the owner of the run has as many runs waiting
+	// as one owner may have.
+	ErrTooManyQueued = errors.New("too many executions queued")
+)
+
+// BusyError is returned by Engine.Execute for a run turned away because the
+// queue has no room for it.
+type BusyError struct {
+	Err error
+
+	// RetryAfter is how long the queue is expected to take to make room.
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string { return e.Err.Error() }
+
+func (e *BusyError) Unwrap() error { return e.Err }
+
+// PoolConfig sizes the pool of runs an Engine executes at once.
+type PoolConfig struct {
+	// Workers is how many runs execute at once.
+	Workers int
+
+	// QueueSize is how many runs may wait for a worker.
+	QueueSize int
+
+	// MaxQueuedPerOwner is how many of them may belong to one owner.
+	MaxQueuedPerOwner int
+}
+
+// PoolConfigFromEnv reads EXEC_WORKERS, EXEC_QUEUE_SIZE and
+// EXEC_QUEUE_PER_OWNER, using a worker per CPU, a queue of 100 and 10 runs
+// per owner for those that are unset.
+func PoolConfigFromEnv() PoolConfig {
+	return PoolConfig{
+		Workers:           envInt("EXEC_WORKERS", runtime.NumCPU()),
+		QueueSize:         envInt("EXEC_QUEUE_SIZE", 100),
+		MaxQueuedPerOwner: envInt("EXEC_QUEUE_PER_OWNER", 10),
+	}
+}
+
+func envInt(name string, fallback int) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || n <= 0 {
+		return fallback
+	}
+	return n
+}
+
+// scheduler hands out workers to runs. Runs that find every worker busy
+// wait in a queue per owner, and owners take turns, so that someone
+// running a lot of code only delays their own runs.
+type scheduler struct {
+	config PoolConfig
+
+	mu      sync.Mutex
+	running int
+	// owners lists the owners with runs waiting, the next one to get a
+	// worker first.
+	owners []string
+	queues map[string][]*waiter
+	queued int
+	// avgRun is a moving average of how long runs take, to estimate when a
+	// full queue will have room.
+	avgRun time.Duration
+}
+
+type waiter struct {
+	ready chan struct{}
+
+	// moved is signalled when position changes.
+	moved    chan struct{}
+	position int
+}
+
+func newScheduler(config PoolConfig) *scheduler {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	return &scheduler{
+		config: config,
+		queues: make(map[string][]*waiter),
+		avgRun: time.Second,
+	}
+}
+
+// acquire waits for a worker for a run of owner. While it waits, it calls
+// queued with the run's position in the queue, 1 being next, whenever that
+// changes. A run that acquires a worker must release it.
+func (s *scheduler) acquire(ctx context.Context, owner string, queued func(position int)) error {
+	s.mu.Lock()
+	if s.running < s.config.Workers && s.queued == 0 {
+		s.running++
+		s.mu.Unlock()
+		return nil
+	}
+	if s.queued >= s.config.QueueSize {
+		err := &BusyError{Err: ErrQueueFull, RetryAfter: s.retryAfter()}
+		s.mu.Unlock()
+		return err
+	}
+	if s.config.MaxQueuedPerOwner > 0 && len(s.queues[owner]) >= s.config.MaxQueuedPerOwner {
+		err := &BusyError{Err: ErrTooManyQueued, RetryAfter: s.retryAfter()}
+		s.mu.Unlock()
+		return err
+	}
+
+	w := &waiter{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	if len(s.queues[owner]) == 0 {
+		s.owners = append(s.owners, owner)
+	}
+	s.queues[owner] = append(s.queues[owner], w)
+	s.queued++
+	s.updatePositions()
+	s.mu.Unlock()
+
+	for {
+		select {
+		case <-w.ready:
+			return nil
+		case <-w.moved:
+			s.mu.Lock()
+			position := w.position
+			s.mu.Unlock()
+			if queued != nil && position > 0 {
+				queued(position)
+			}
+		case <-ctx.Done():
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if !s.remove(owner, w) {
+				// It was handed a worker in the meantime.
+				s.releaseLocked(0)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+// release returns the worker of a run that took elapsed to the pool.
+func (s *scheduler) release(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked(elapsed)
+}
+
+func (s *scheduler) releaseLocked(elapsed time.Duration) {
+	if elapsed > 0 {
+		s.avgRun = (4*s.avgRun + elapsed) / 5
+	}
+	if s.queued == 0 {
+		s.running--
+		return
+	}
+
+	// The worker goes straight to the next run.
+	owner := s.owners[0]
+	queue := s.queues[owner]
+	w := queue[0]
+	s.owners = s.owners[1:]
+	if len(queue) > 1 {
+		s.queues[owner] = queue[1:]
+		s.owners = append(s.owners, owner)
+	} else {
+		delete(s.queues, owner)
+	}
+	s.queued--
+	w.position = 0
+	close(w.ready)
+	s.updatePositions()
+}
+
+// remove takes w out of the queue, reporting whether it was there.
+func (s *scheduler) remove(owner string, w *waiter) bool {
+	queue := s.queues[owner]
+	for i, other := range queue {
+		if other != w {
+			continue
+		}
+		queue = append(queue[:i:i], queue[i+1:]...)
+		if len(queue) > 0 {
+			s.queues[owner] = queue
+		} else {
+			delete(s.queues, owner)
+			for j, o := range s.owners {
+				if o == owner {
+					s.owners = append(s.owners[:j:j], s.owners[j+1:]...)
+					break
+				}
+			}
+		}
+		s.queued--
+		s.updatePositions()
+		return true
+	}
+	return false
+}
+
+// updatePositions works out where each waiting run is in line and tells
+// those that moved. Owners take turns, so the k-th run of an owner comes
+// after the first k runs of everyone else.
+func (s *scheduler) updatePositions() {
+	for i, owner := range s.owners {
+		for k, w := range s.queues[owner] {
+			position := 1
+			for j, other := range s.owners {
+				n := min(len(s.queues[other]), k)
+				if j < i && len(s.queues[other]) > k {
+					n++
+				}
+				position += n
+			}
+			if w.position != position {
+				w.position = position
+				select {
+				case w.moved <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// retryAfter estimates how long the queue takes to go through the runs
+// waiting in it.
+func (s *scheduler) retryAfter() time.Duration {
+	wait := s.avgRun * time.Duration(s.queued/s.config.Workers+1)
+	return max(wait.Round(time.Second), time.Second)
+}
@@ -0,0 +1,175 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueRun starts waiting for a worker in the background. The returned
+// channel receives the outcome.
+func queueRun(t *testing.T, s *scheduler, ctx context.Context, owner string, positions chan<- int) <-chan error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.acquire(ctx, owner, func(position int) {
+			if positions != nil {
+				positions <- position
+			}
+		})
+	}()
+	return done
+}
+
+func waitQueued(t *testing.T, s *scheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		queued := s.queued
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d runs queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerTakesTurnsBetweenOwners(t *testing.T) {
+	s := newScheduler(PoolConfig{Workers: 1, QueueSize: 10, MaxQueuedPerOwner: 10})
+	ctx := context.Background()
+	if err := s.acquire(ctx, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice queues two runs before Bob queues one; Bob's still goes second.
+	alice1 := queueRun(t, s, ctx, "alice", nil)
+	waitQueued(t, s, 1)
+	positions := make(chan int, 10)
+	alice2 := queueRun(t, s, ctx, "alice", positions)
+	if p := <-positions; p != 2 {
+		t.Errorf("alice's second run queued at %d, want 2", p)
+	}
+	bob := queueRun(t, s, ctx, "bob", nil)
+	waitQueued(t, s, 3)
+	if p := <-positions; p != 3 {
+		t.Errorf("alice's second run moved to %d after bob queued, want 3", p)
+	}
+
+	var order []string
+	for range 3 {
+		s.release(time.Millisecond)
+		select {
+		case <-alice1:
+			order = append(order, "alice")
+		case <-alice2:
+			order = append(order, "alice2")
+		case <-bob:
+			order = append(order, "bob")
+		case <-time.After(time.Second):
+			t.Fatal("no run got the worker")
+		}
+	}
+	if want := []string{"alice", "bob", "alice2"}; !equalLines(order, want) {
+		t.Errorf("runs went in order %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerTurnsRunsAway(t *testing.T) {
+	s := newScheduler(PoolConfig{Workers: 1, QueueSize: 2, MaxQueuedPerOwner: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := s.acquire(ctx, "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	queueRun(t, s, ctx, "alice", nil)
+	waitQueued(t, s, 1)
+
+	var busy *BusyError
+	err := s.acquire(ctx, "alice", nil)
+	if !errors.As(err, &busy) || !errors.Is(err, ErrTooManyQueued) || busy.RetryAfter < time.Second {
+		t.Errorf("expected alice to be told to retry later, got %v", err)
+	}
+
+	queueRun(t, s, ctx, "bob", nil)
+	waitQueued(t, s, 2)
+	if err := s.acquire(ctx, "carol", nil); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("expected a full queue, got %v", err)
+	}
+}
+
+func TestSchedulerCancelWhileQueued(t *testing.T) {
+	s := newScheduler(PoolConfig{Workers: 1, QueueSize: 10, MaxQueuedPerOwner: 10})
+	if err := s.acquire(context.Background(), "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := queueRun(t, s, ctx, "alice", nil)
+	waitQueued(t, s, 1)
+	positions := make(chan int, 10)
+	next := queueRun(t, s, context.Background(), "bob", positions)
+	if p := <-positions; p != 2 {
+		t.Errorf("bob's run queued at %d, want 2", p)
+	}
+
+	cancel()
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire = %v, want context.Canceled", err)
+	}
+	if p := <-positions; p != 1 {
+		t.Errorf("bob's run moved to %d, want 1", p)
+	}
+
+	s.release(time.Millisecond)
+	if err := <-next; err != nil {
+		t.Errorf("acquire = %v", err)
+	}
+}
+
+func TestEngineBoundsConcurrentRuns(t *testing.T) {
+	var mu sync.Mutex
+	running, peak := 0, 0
+	runner := executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return &Result{}, nil
+	})
+	e := &Engine{
+		runtimes: map[string]Executor{"test": runner},
+		pool:     newScheduler(PoolConfig{Workers: 2, QueueSize: 100, MaxQueuedPerOwner: 100}),
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := e.Execute(context.Background(), "test", &Request{Owner: "alice"}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if peak != 2 {
+		t.Errorf("%d runs executed at once, want 2", peak)
+	}
+}
+
+type executorFunc func(ctx context.Context, req *Request) (*Result, error)
+
+func (f executorFunc) Run(ctx context.Context, req *Request) (*Result, error) {
+	return f(ctx, req)
+}
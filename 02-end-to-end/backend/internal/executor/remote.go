@@ -0,0 +1,278 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// A remote run is a connection to a runner on its Unix socket. The API
+// server writes a remoteRequest, and the runner answers with a frame per
+// chunk of output and per move in its queue, followed by one holding the
+// outcome, each a line of JSON.
+// Closing the connection before the outcome cancels the run.
+
+// remoteGrace is how long a RemoteExecutor waits past its deadline for the
+// runner, which enforces the same deadline, to report the run timed out.
+const remoteGrace = time.Second
+
+type remoteRequest struct {
+	Language   string            `json:"language"`
+	Code       string            `json:"code"`
+	Entrypoint string            `json:"entrypoint,omitempty"`
+	Files      map[string]string `json:"files,omitempty"`
+	Stdin      string            `json:"stdin,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	Owner      string            `json:"owner,omitempty"`
+	Timeout    time.Duration     `json:"timeout,omitempty"`
+}
+
+type remoteFrame struct {
+	// Queued: where the run is in the runner's queue, 1 being next.
+	Queued int `json:"queued,omitempty"`
+
+	// Output: a chunk of one of the streams. It is sent as bytes, since a
+	// chunk may end partway through a character.
+	Stream string `json:"stream,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// Outcome: what Engine.Execute returned.
+	Done   bool          `json:"done,omitempty"`
+	Result *Result       `json:"result,omitempty"`
+	Error  *CompileError `json:"compileError,omitempty"`
+	// Busy is set, to one of busyReasons, if the runner's queue had no
+	// room for the run.
+	Busy       string        `json:"busy,omitempty"`
+	RetryAfter time.Duration `json:"retryAfter,omitempty"`
+	// Message is the text of any other error.
+	Message   string `json:"error,omitempty"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+}
+
+// busyReasons names the errors of a BusyError in frames.
+var busyReasons = map[string]error{
+	"queue-full":      ErrQueueFull,
+	"too-many-queued": ErrTooManyQueued,
+}
+
+// busyReason returns the name of err in busyReasons.
+func busyReason(err error) string {
+	for reason, busyErr := range busyReasons {
+		if errors.Is(err, busyErr) {
+			return reason
+		}
+	}
+	return ""
+}
+
+// RemoteExecutor runs code of a language in a runner process listening on
+// Socket (see cmd/runner), so that a run that crashes or exhausts memory
+// takes down the runner and not the API server.
+type RemoteExecutor struct {
+	Socket   string
+	Language string
+}
+
+func (x *RemoteExecutor) Run(ctx context.Context, req *Request) (*Result, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", x.Socket)
+	if err != nil {
+		return nil, fmt.Errorf("runner is unavailable: %w", err)
+	}
+	defer conn.Close()
+
+	request := remoteRequest{
+		Language:   x.Language,
+		Code:       req.Code,
+		Entrypoint: req.Entrypoint,
+		Files:      req.Files,
+		Stdin:      req.Stdin,
+		Args:       req.Args,
+		Owner:      req.Owner,
+		Timeout:    req.Timeout,
+	}
+	if deadline, ok := ctx.Deadline(); ok && request.Timeout == 0 {
+		request.Timeout = time.Until(deadline)
+	}
+	if err := json.NewEncoder(conn).Encode(request); err != nil {
+		return nil, fmt.Errorf("could not send run to runner: %w", err)
+	}
+
+	type outcome struct {
+		frame *remoteFrame
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		frame, err := readFrames(conn, req)
+		done <- outcome{frame, err}
+	}()
+
+	var o outcome
+	select {
+	case o = <-done:
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			conn.Close()
+			<-done
+			return nil, ctx.Err()
+		}
+		// The runner stops the program at the same deadline.
+		select {
+		case o = <-done:
+		case <-time.After(remoteGrace):
+			conn.Close()
+			<-done
+			return &Result{LimitExceeded: LimitTime}, nil
+		}
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+
+	frame := o.frame
+	switch {
+	case frame.Error != nil:
+		return frame.Result, frame.Error
+	case frame.Cancelled:
+		return frame.Result, context.Canceled
+	case busyReasons[frame.Busy] != nil:
+		return frame.Result, &BusyError{Err: busyReasons[frame.Busy], RetryAfter: frame.RetryAfter}
+	case frame.Message != "":
+		return frame.Result, errors.New(frame.Message)
+	}
+	return frame.Result, nil
+}
+
+// readFrames passes on the output the runner sends until the outcome.
+func readFrames(conn net.Conn, req *Request) (*remoteFrame, error) {
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var frame remoteFrame
+		if err := dec.Decode(&frame); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("runner failed: %w", err)
+		}
+		if frame.Done {
+			return &frame, nil
+		}
+		if frame.Queued > 0 {
+			if req.Queued != nil {
+				req.Queued(frame.Queued)
+			}
+			continue
+		}
+
+		stream := req.Stdout
+		if frame.Stream == streamStderr {
+			stream = req.Stderr
+		}
+		if stream != nil {
+			stream.Write(frame.Data)
+		}
+	}
+}
+
+// Output streams named in frames.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// Serve runs code sent by RemoteExecutors connecting to l with e, until l is
+// closed.
+func Serve(l net.Listener, e *Engine) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveRun(conn, e)
+	}
+}
+
+func serveRun(conn net.Conn, e *Engine) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	var request remoteRequest
+	if err := json.NewDecoder(reader).Decode(&request); err != nil {
+		log.Printf("Invalid run request: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The other end hanging up cancels the run; it sends nothing else.
+	go func() {
+		io.Copy(io.Discard, reader)
+		cancel()
+	}()
+
+	out := &frameWriter{enc: json.NewEncoder(conn)}
+	result, err := e.Execute(ctx, request.Language, &Request{
+		Code:       request.Code,
+		Entrypoint: request.Entrypoint,
+		Files:      request.Files,
+		Stdin:      request.Stdin,
+		Args:       request.Args,
+		Owner:      request.Owner,
+		Timeout:    request.Timeout,
+		Stdout:     out.stream(streamStdout),
+		Stderr:     out.stream(streamStderr),
+		Queued: func(position int) {
+			out.write(&remoteFrame{Queued: position})
+		},
+	})
+
+	frame := &remoteFrame{Done: true, Result: result}
+	var compileErr *CompileError
+	var busy *BusyError
+	switch {
+	case errors.As(err, &compileErr):
+		frame.Error = compileErr
+	case errors.Is(err, context.Canceled):
+		frame.Cancelled = true
+	case errors.As(err, &busy) && busyReason(busy.Err) != "":
+		frame.Busy, frame.RetryAfter = busyReason(busy.Err), busy.RetryAfter
+	case err != nil:
+		frame.Message = err.Error()
+	}
+	out.write(frame)
+}
+
+// frameWriter sends frames on a run's connection.
+type frameWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (w *frameWriter) write(frame *remoteFrame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// A write fails if the API server hung up, which cancels the run.
+	w.enc.Encode(frame)
+}
+
+func (w *frameWriter) stream(name string) io.Writer {
+	return frameStream{out: w, name: name}
+}
+
+type frameStream struct {
+	out  *frameWriter
+	name string
+}
+
+func (s frameStream) Write(p []byte) (int, error) {
+	s.out.write(&remoteFrame{Stream: s.name, Data: p})
+	return len(p), nil
+}
@@ -0,0 +1,263 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/models"
+)
+
+// startRunner serves runs of "test" with runner on a socket, and returns an
+// executor sending runs to it.
+func startRunner(t *testing.T, runner Executor) *RemoteExecutor {
+	t.Helper()
+	return startRunnerWithPool(t, runner, newScheduler(PoolConfig{Workers: 4, QueueSize: 10}))
+}
+
+// startRunnerWithPool is startRunner with the runner's runs scheduled by pool.
+func startRunnerWithPool(t *testing.T, runner Executor, pool *scheduler) *RemoteExecutor {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "runner.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	e := &Engine{
+		runtimes: map[string]Executor{"test": runner},
+		pool:     pool,
+	}
+	go Serve(l, e)
+	return &RemoteExecutor{Socket: socket, Language: "test"}
+}
+
+func TestRemoteExecutorRuns(t *testing.T) {
+	remote := startRunner(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		if req.Stdin != "in" || len(req.Args) != 1 || req.Args[0] != "-v" || req.Entrypoint != "app.py" || req.Files["lib.py"] != "x = 1" {
+			t.Errorf("runner got %+v", req)
+		}
+		io.WriteString(req.Stdout, "out\n")
+		io.WriteString(req.Stderr, "err\n")
+		return &Result{Stdout: "out\n", Stderr: "err\n", ExitCode: 2}, nil
+	}))
+
+	var stdout, stderr strings.Builder
+	result, err := remote.Run(context.Background(), &Request{
+		Code:       "code",
+		Entrypoint: "app.py",
+		Files:      map[string]string{"lib.py": "x = 1"},
+		Stdin:      "in",
+		Args:       []string{"-v"},
+		Stdout:     &stdout,
+		Stderr:     &stderr,
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Stdout != "out\n" || result.Stderr != "err\n" || result.ExitCode != 2 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("streamed stdout %q, stderr %q", stdout.String(), stderr.String())
+	}
+}
+
+func TestRemoteExecutorSplitCharacters(t *testing.T) {
+	remote := startRunner(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		// A buffer flushed partway through "é".
+		req.Stdout.Write([]byte("caf\xc3"))
+		req.Stdout.Write([]byte("\xa9\n"))
+		return &Result{Stdout: "café\n"}, nil
+	}))
+
+	var stdout strings.Builder
+	if _, err := remote.Run(context.Background(), &Request{Code: "code", Stdout: &stdout}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if stdout.String() != "café\n" {
+		t.Errorf("streamed stdout %q, want %q", stdout.String(), "café\n")
+	}
+}
+
+func TestRemoteExecutorCompileError(t *testing.T) {
+	remote := startRunner(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		return nil, &CompileError{
+			Diagnostics: []models.Diagnostic{{File: "main.go", Line: 3, Message: "undefined: x"}},
+			Output:      "./main.go:3: undefined: x\n",
+		}
+	}))
+
+	_, err := remote.Run(context.Background(), &Request{Code: "code"})
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) || len(compileErr.Diagnostics) != 1 || compileErr.Diagnostics[0].Line != 3 {
+		t.Errorf("expected the compile error to come through, got %v", err)
+	}
+}
+
+func TestRemoteExecutorQueuesByOwner(t *testing.T) {
+	owners := make(chan string, 1)
+	pool := newScheduler(PoolConfig{Workers: 1, QueueSize: 10, MaxQueuedPerOwner: 1})
+	remote := startRunnerWithPool(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		owners <- req.Owner
+		return &Result{}, nil
+	}), pool)
+
+	// Another owner keeps the runner's only worker busy.
+	if err := pool.acquire(context.Background(), "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	queued := make(chan error, 1)
+	go func() {
+		_, err := remote.Run(context.Background(), &Request{Code: "code", Owner: "alice"})
+		queued <- err
+	}()
+	waitQueued(t, pool, 1)
+
+	// The runner's limit per owner comes back as a BusyError.
+	_, err := remote.Run(context.Background(), &Request{Code: "code", Owner: "alice"})
+	var busy *BusyError
+	if !errors.As(err, &busy) || !errors.Is(err, ErrTooManyQueued) || busy.RetryAfter < time.Second {
+		t.Errorf("expected alice to be told to retry later, got %v", err)
+	}
+
+	pool.release(0)
+	if err := <-queued; err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if owner := <-owners; owner != "alice" {
+		t.Errorf("runner ran it for %q, want alice", owner)
+	}
+}
+
+func TestEngineLeavesRemoteRunsToRunnerQueue(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	pool := newScheduler(PoolConfig{Workers: 2, QueueSize: 10})
+	remote := startRunnerWithPool(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		started <- struct{}{}
+		<-release
+		return &Result{}, nil
+	}), pool)
+
+	// The engine has a single worker, but the runner has two.
+	e := &Engine{
+		runtimes: map[string]Executor{"test": remote},
+		pool:     newScheduler(PoolConfig{Workers: 1, QueueSize: 10}),
+	}
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := e.Execute(context.Background(), "test", &Request{Code: "code"})
+			done <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("Expected both runs to start on the runner")
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Errorf("Execute failed: %v", err)
+		}
+	}
+
+	// Positions in the runner's queue come back to the caller.
+	if err := pool.acquire(context.Background(), "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := pool.acquire(context.Background(), "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	positions := make(chan int, 1)
+	go e.Execute(context.Background(), "test", &Request{Code: "code", Owner: "alice", Queued: func(position int) {
+		positions <- position
+	}})
+	select {
+	case position := <-positions:
+		if position != 1 {
+			t.Errorf("Queued at %d, want 1", position)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the run's position in the runner's queue")
+	}
+	pool.release(0)
+}
+
+func TestRemoteExecutorCancel(t *testing.T) {
+	stopped := make(chan error, 1)
+	remote := startRunner(t, executorFunc(func(ctx context.Context, req *Request) (*Result, error) {
+		io.WriteString(req.Stdout, "started\n")
+		<-ctx.Done()
+		stopped <- ctx.Err()
+		return nil, ctx.Err()
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stdout := writerFunc(func(p []byte) (int, error) {
+		close(started)
+		return len(p), nil
+	})
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	if _, err := remote.Run(ctx, &Request{Code: "code", Stdout: stdout}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Run = %v, want context.Canceled", err)
+	}
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("runner stopped with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("the run kept going in the runner")
+	}
+}
+
+func TestRemoteExecutorRunnerFails(t *testing.T) {
+	remote := &RemoteExecutor{Socket: filepath.Join(t.TempDir(), "missing.sock"), Language: "test"}
+	if _, err := remote.Run(context.Background(), &Request{Code: "code"}); err == nil {
+		t.Error("expected an error without a runner")
+	}
+
+	// A runner that goes away mid-run.
+	socket := filepath.Join(t.TempDir(), "runner.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			bufio.NewReader(conn).ReadString('\n')
+			conn.Write([]byte(`{"stream":"stdout","data":"cGFydGlhbA=="}` + "\n"))
+			conn.Close()
+		}
+	}()
+
+	remote.Socket = socket
+	if _, err := remote.Run(context.Background(), &Request{Code: "code"}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Run = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
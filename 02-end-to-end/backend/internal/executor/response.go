@@ -0,0 +1,43 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/internal/models"
+)
+
+// NewResponse describes the outcome of an execution for API clients.
+func NewResponse(result *Result, err error, elapsed time.Duration) models.ExecuteResponse {
+	resp := models.ExecuteResponse{
+		Success:       err == nil && result.ExitCode == 0 && result.LimitExceeded == "",
+		ExecutionTime: elapsed.Milliseconds(),
+	}
+	if result != nil {
+		resp.Output = result.Stdout
+		resp.Stdout = result.Stdout
+		resp.Stderr = result.Stderr
+		resp.ExitCode = result.ExitCode
+		resp.LimitExceeded = result.LimitExceeded
+	}
+
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		resp.Stderr = compileErr.Output
+		resp.Diagnostics = compileErr.Diagnostics
+	}
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		resp.Error = "execution cancelled"
+	case err != nil:
+		resp.Error = err.Error()
+	case result.LimitExceeded != "":
+		resp.Error = result.LimitExceeded + " limit exceeded"
+	case result.ExitCode != 0:
+		resp.Error = fmt.Sprintf("exited with status %d", result.ExitCode)
+	}
+	return resp
+}
@@ -0,0 +1,180 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+)
+
+const (
+	// TestTimeout is how long a test case may run unless it asks for less.
+	TestTimeout = 10 * time.Second
+
+	// TestParallelism caps how many cases of one request run at once.
+	TestParallelism = 4
+
+	// MaxTestCases is how many cases one request may have.
+	MaxTestCases = 50
+
+	// maxDiffCells bounds the work of a line diff. Outputs with more lines
+	// than that allows are only compared up to their first difference.
+	maxDiffCells = 1 << 20
+)
+
+// ExecuteFunc runs a request in a language, like Engine.Execute.
+type ExecuteFunc func(ctx context.Context, language string, req *Request) (*Result, error)
+
+// RunTests runs the code of req for owner once per test case, feeding the
+// case's stdin and comparing what it prints with the expected output. Cases
+// run in parallel, up to TestParallelism at a time.
+//
+// A case passes if the program exits cleanly and its output matches, ignoring
+// trailing whitespace on each line and trailing blank lines.
+func RunTests(ctx context.Context, execute ExecuteFunc, req *models.ExecuteTestsRequest, owner string) models.ExecuteTestsResponse {
+	start := time.Now()
+	results := make([]models.TestResult, len(req.Tests))
+
+	sem := make(chan struct{}, TestParallelism)
+	var wg sync.WaitGroup
+	for i, tc := range req.Tests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = models.TestResult{ExecuteResponse: NewResponse(nil, ctx.Err(), 0)}
+				return
+			}
+			defer func() { <-sem }()
+			results[i] = runTest(ctx, execute, req, tc, owner)
+		}()
+	}
+	wg.Wait()
+
+	resp := models.ExecuteTestsResponse{
+		Total:         len(results),
+		Results:       results,
+		ExecutionTime: time.Since(start).Milliseconds(),
+	}
+	for _, result := range results {
+		if result.Passed {
+			resp.Passed++
+		}
+	}
+	return resp
+}
+
+func runTest(ctx context.Context, execute ExecuteFunc, req *models.ExecuteTestsRequest, tc models.TestCase, owner string) models.TestResult {
+	timeout := TestTimeout
+	if t := time.Duration(tc.Timeout) * time.Millisecond; t > 0 && t < timeout {
+		timeout = t
+	}
+
+	start := time.Now()
+	result, err := execute(ctx, req.Language, &Request{
+		Code:       req.Code,
+		Entrypoint: req.Entrypoint,
+		Files:      req.Files,
+		Stdin:      tc.Stdin,
+		Args:       req.Args,
+		Owner:      owner,
+		Timeout:    timeout,
+	})
+	test := models.TestResult{ExecuteResponse: NewResponse(result, err, time.Since(start))}
+	if result == nil {
+		return test
+	}
+
+	expected, actual := outputLines(tc.ExpectedOutput), outputLines(result.Stdout)
+	if !equalLines(expected, actual) {
+		test.Diff = diffLines(expected, actual)
+		return test
+	}
+	test.Passed = test.Success
+	return test
+}
+
+// outputLines splits output into lines without the whitespace that graders
+// don't care about.
+func outputLines(output string) []string {
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// diffLines describes how to turn the expected lines into the actual ones:
+// lines only expected start with "-", lines only printed with "+", and
+// lines in both with a space.
+func diffLines(expected, actual []string) string {
+	var b strings.Builder
+	if len(expected)*len(actual) > maxDiffCells {
+		i := 0
+		for i < len(expected) && i < len(actual) && expected[i] == actual[i] {
+			i++
+		}
+		fmt.Fprintf(&b, "output differs from line %d\n", i+1)
+		if i < len(expected) {
+			fmt.Fprintf(&b, "-%s\n", expected[i])
+		}
+		if i < len(actual) {
+			fmt.Fprintf(&b, "+%s\n", actual[i])
+		}
+		return b.String()
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// expected[i:] and actual[j:].
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(actual)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(actual) - 1; j >= 0; j-- {
+			if expected[i] == actual[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && j < len(actual) && expected[i] == actual[j]:
+			fmt.Fprintf(&b, " %s\n", expected[i])
+			i++
+			j++
+		case j == len(actual) || (i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&b, "-%s\n", expected[i])
+			i++
+		default:
+			fmt.Fprintf(&b, "+%s\n", actual[j])
+			j++
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"backend/internal/models"
+)
+
+func TestRunTests(t *testing.T) {
+	var running, peak atomic.Int32
+	// Doubles the number it reads, but gets 3 wrong.
+	execute := func(ctx context.Context, language string, req *Request) (*Result, error) {
+		now := running.Add(1)
+		for p := peak.Load(); now > p && !peak.CompareAndSwap(p, now); p = peak.Load() {
+		}
+		defer running.Add(-1)
+		time.Sleep(10 * time.Millisecond)
+
+		switch strings.TrimSpace(req.Stdin) {
+		case "crash":
+			return &Result{Stdout: "0\n", ExitCode: 1}, nil
+		case "slow":
+			if req.Timeout > 100*time.Millisecond {
+				t.Errorf("Timeout = %v, want the case's", req.Timeout)
+			}
+			return &Result{LimitExceeded: LimitTime}, nil
+		case "3":
+			return &Result{Stdout: "7\n"}, nil
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(req.Stdin))
+		// Trailing whitespace doesn't matter.
+		return &Result{Stdout: strconv.Itoa(2*n) + "  \n\n"}, nil
+	}
+
+	req := &models.ExecuteTestsRequest{Code: "double", Language: "python"}
+	for i := 1; i <= 8; i++ {
+		req.Tests = append(req.Tests, models.TestCase{Stdin: strconv.Itoa(i) + "\n", ExpectedOutput: strconv.Itoa(2*i) + "\n"})
+	}
+	req.Tests = append(req.Tests,
+		models.TestCase{Stdin: "crash", ExpectedOutput: "0"},
+		models.TestCase{Stdin: "slow", ExpectedOutput: "", Timeout: 50},
+	)
+
+	resp := RunTests(context.Background(), execute, req, "alice")
+
+	if resp.Total != 10 || resp.Passed != 7 || len(resp.Results) != 10 {
+		t.Fatalf("got %d of %d passed, %d results", resp.Passed, resp.Total, len(resp.Results))
+	}
+	for i, result := range resp.Results[:8] {
+		if result.Passed != (i != 2) {
+			t.Errorf("case %d: Passed = %v", i+1, result.Passed)
+		}
+	}
+	if diff := resp.Results[2].Diff; diff != "-6\n+7\n" {
+		t.Errorf("Diff = %q", diff)
+	}
+	if crash := resp.Results[8]; crash.Passed || crash.Diff != "" || crash.ExitCode != 1 {
+		t.Errorf("a failing program with the right output should fail without a diff, got %+v", crash)
+	}
+	if slow := resp.Results[9]; slow.Passed || slow.LimitExceeded != LimitTime {
+		t.Errorf("Unexpected result for the slow case %+v", slow)
+	}
+	if peak.Load() > TestParallelism {
+		t.Errorf("%d cases ran at once, want at most %d", peak.Load(), TestParallelism)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		expected, actual string
+		want             string
+	}{
+		{"a\nb\nc", "a\nc", " a\n-b\n c\n"},
+		{"a\nc", "a\nb\nc", " a\n+b\n c\n"},
+		{"a\nb", "a\nx", " a\n-b\n+x\n"},
+		{"", "a", "+a\n"},
+	}
+	for _, tt := range tests {
+		if got := diffLines(outputLines(tt.expected), outputLines(tt.actual)); got != tt.want {
+			t.Errorf("diffLines(%q, %q) = %q, want %q", tt.expected, tt.actual, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Command guest stands in for an interpreter in the executor tests. It
+// prints the script whose path is its first argument, reports its other
+// arguments and whether a mounted library is readable, and exits with the
+// status named on a line reading "exit N". A line reading "stdin" echoes its
+// input, and one reading "cat PATH" prints the file at PATH; other lines make
+// it misbehave, to hit the executor's limits.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: guest script [args...]")
+		os.Exit(2)
+	}
+	script, err := os.ReadFile(os.Args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	fmt.Print(string(script))
+
+	if len(os.Args) > 2 {
+		fmt.Fprintf(os.Stderr, "args: %q\n", os.Args[2:])
+	}
+
+	if lib, err := os.ReadFile("/usr/local/lib/lib.txt"); err == nil {
+		fmt.Fprintf(os.Stderr, "lib: %s", lib)
+	}
+	if err := os.WriteFile("/sandbox/out.txt", nil, 0o644); err == nil {
+		fmt.Fprintln(os.Stderr, "sandbox is writable")
+	}
+	if os.Getenv("GUEST_ENV") != "" {
+		fmt.Fprintln(os.Stderr, "env:", os.Getenv("GUEST_ENV"))
+	}
+
+	for _, line := range strings.Split(string(script), "\n") {
+		var code int
+		if _, err := fmt.Sscanf(line, "exit %d", &code); err == nil {
+			os.Exit(code)
+		}
+		if name, ok := strings.CutPrefix(line, "cat "); ok {
+			file, err := os.ReadFile(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			fmt.Print(string(file))
+		}
+		switch line {
+		case "stdin":
+			io.Copy(os.Stdout, os.Stdin)
+		case "loop":
+			for {
+			}
+		case "alloc":
+			var hold [][]byte
+			for {
+				hold = append(hold, make([]byte, 1<<20))
+			}
+		case "calls":
+			for i := 0; ; i++ {
+				work(i)
+			}
+		case "spam":
+			for {
+				fmt.Println("spam spam spam")
+			}
+		}
+	}
+}
+
+//go:noinline
+func work(i int) int {
+	return i * 2
+}
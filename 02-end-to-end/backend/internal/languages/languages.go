@@ -0,0 +1,175 @@
+// Package languages describes the programming languages sessions can be
+// written in: how they are shown, which template a new session starts from
+// and how the executor runs them. The set comes from a JSON file, so adding
+// a language is a configuration change.
+package languages
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// defaultConfig is the registry used unless LANGUAGES_CONFIG names another.
+//
+//go:embed languages.json
+var defaultConfig []byte
+
+// Executor types.
+const (
+	// ExecutorWasm runs the code with an interpreter compiled to WASI.
+	ExecutorWasm = "wasm"
+
+	// ExecutorGo compiles Go code to WASI and runs it.
+	ExecutorGo = "go"
+)
+
+// Language is a language sessions can be written in.
+type Language struct {
+	Info
+	Executor Executor `json:"executor"`
+}
+
+// Info is what clients are told about a language.
+type Info struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Extension string `json:"extension"`
+	// Monaco is the editor's mode for the language.
+	Monaco string `json:"monaco"`
+	// Template is the code a new session starts with.
+	Template string `json:"template"`
+}
+
+// Executor tells the executor how to run a language.
+type Executor struct {
+	Type string `json:"type"`
+
+	// wasm: the interpreter, the file the code is written to, the
+	// interpreter's flags, host directories mounted read-only at guest
+	// paths, and the environment.
+	Binary     string            `json:"binary,omitempty"`
+	ScriptName string            `json:"scriptName,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	Mounts     map[string]string `json:"mounts,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+
+	// Limits override the executor's default limits.
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// DefaultEntrypoint is the file a new session in the language runs: the
+// executor's script name, or "main" with the language's extension.
+func (l *Language) DefaultEntrypoint() string {
+	if l.Executor.ScriptName != "" {
+		return l.Executor.ScriptName
+	}
+	return "main" + l.Extension
+}
+
+// Limits bound a single run. A zero field means no limit.
+type Limits struct {
+	MemoryPages uint32 `json:"memoryPages"`
+	MaxCalls    uint64 `json:"maxCalls"`
+	MaxOutput   int    `json:"maxOutput"`
+}
+
+// Registry is the set of languages, in the order they are listed.
+type Registry struct {
+	languages []Language
+	byID      map[string]*Language
+}
+
+// Default returns the registry built into the server.
+func Default() *Registry {
+	r, err := Parse(defaultConfig)
+	if err != nil {
+		panic(fmt.Sprintf("invalid built-in languages: %v", err))
+	}
+	return r
+}
+
+// FromEnv loads the registry from the file named by LANGUAGES_CONFIG, or
+// returns the built-in one if it is unset.
+func FromEnv() (*Registry, error) {
+	path := os.Getenv("LANGUAGES_CONFIG")
+	if path == "" {
+		return Default(), nil
+	}
+	return Load(path)
+}
+
+// Load reads a registry from a JSON file listing the languages.
+func Load(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return r, nil
+}
+
+// Parse reads a registry from JSON listing the languages.
+func Parse(data []byte) (*Registry, error) {
+	var languages []Language
+	if err := json.Unmarshal(data, &languages); err != nil {
+		return nil, err
+	}
+
+	r := &Registry{languages: languages, byID: make(map[string]*Language)}
+	for i := range languages {
+		lang := &languages[i]
+		if lang.ID == "" {
+			return nil, fmt.Errorf("language %d has no id", i)
+		}
+		if _, ok := r.byID[lang.ID]; ok {
+			return nil, fmt.Errorf("language %s is listed twice", lang.ID)
+		}
+		switch lang.Executor.Type {
+		case ExecutorGo:
+		case ExecutorWasm:
+			if lang.Executor.Binary == "" {
+				return nil, fmt.Errorf("language %s has no binary", lang.ID)
+			}
+		default:
+			return nil, fmt.Errorf("language %s has unknown executor type %q", lang.ID, lang.Executor.Type)
+		}
+		r.byID[lang.ID] = lang
+	}
+	return r, nil
+}
+
+// Get returns the language with the given ID.
+func (r *Registry) Get(id string) (*Language, bool) {
+	lang, ok := r.byID[id]
+	return lang, ok
+}
+
+// All returns the languages in the order they are listed.
+func (r *Registry) All() []Language {
+	return append([]Language(nil), r.languages...)
+}
+
+// Infos returns what clients are told about the languages, in the order
+// they are listed.
+func (r *Registry) Infos() []Info {
+	infos := make([]Info, len(r.languages))
+	for i, lang := range r.languages {
+		infos[i] = lang.Info
+	}
+	return infos
+}
+
+// IDs returns the IDs of the languages in the order they are listed.
+func (r *Registry) IDs() []string {
+	ids := make([]string, len(r.languages))
+	for i, lang := range r.languages {
+		ids[i] = lang.ID
+	}
+	return ids
+}
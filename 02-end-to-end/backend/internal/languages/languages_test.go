@@ -0,0 +1,62 @@
+package languages
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefault(t *testing.T) {
+	r := Default()
+	if ids := strings.Join(r.IDs(), ","); ids != "javascript,python,go" {
+		t.Errorf("IDs = %s", ids)
+	}
+
+	python, ok := r.Get("python")
+	if !ok {
+		t.Fatal("python is missing")
+	}
+	if python.Extension != ".py" || python.Monaco != "python" || python.Template == "" {
+		t.Errorf("Unexpected python %+v", python.Info)
+	}
+	if python.Executor.Type != ExecutorWasm || python.Executor.Mounts["wasm/python/lib"] != "/usr/local/lib" {
+		t.Errorf("Unexpected python executor %+v", python.Executor)
+	}
+
+	if _, ok := r.Get("cobol"); ok {
+		t.Error("Get found a language that isn't listed")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "languages.json")
+	config := `[{"id": "lua", "name": "Lua", "executor": {"type": "wasm", "binary": "wasm/lua.wasm", "limits": {"maxCalls": 1000}}}]`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	lua, ok := r.Get("lua")
+	if !ok || lua.Name != "Lua" || lua.Executor.Limits == nil || lua.Executor.Limits.MaxCalls != 1000 {
+		t.Errorf("Unexpected lua %+v", lua)
+	}
+}
+
+func TestParseRejectsInvalidLanguages(t *testing.T) {
+	tests := map[string]string{
+		"no id":          `[{"executor": {"type": "go"}}]`,
+		"duplicate":      `[{"id": "go", "executor": {"type": "go"}}, {"id": "go", "executor": {"type": "go"}}]`,
+		"unknown type":   `[{"id": "go", "executor": {"type": "jvm"}}]`,
+		"missing binary": `[{"id": "lua", "executor": {"type": "wasm"}}]`,
+		"not a list":     `{"id": "go"}`,
+	}
+	for name, config := range tests {
+		if _, err := Parse([]byte(config)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
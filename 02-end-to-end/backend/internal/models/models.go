@@ -13,14 +13,95 @@ type User struct {
 
 // Session represents a coding session
 type Session struct {
-	ID        string    `json:"sessionId" gorm:"primaryKey"`
-	Language  string    `json:"language"`
-	Code      string    `json:"code"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID string `json:"sessionId" gorm:"primaryKey"`
+	// OwnerID is the user who created the session. Sessions created before
+	// sessions had owners are read-only until someone who ran code in one
+	// joins it and claims it.
+	OwnerID  string `json:"ownerId" gorm:"index"`
+	Language string `json:"language"`
+	// Code is the content of the entrypoint, for clients that only know
+	// about a single file.
+	Code string `json:"code"`
+	// Entrypoint is the path of the file that is run.
+	Entrypoint string          `json:"entrypoint"`
+	Files      []SessionFile   `json:"files" gorm:"constraint:OnDelete:CASCADE"`
+	Members    []SessionMember `json:"members,omitempty" gorm:"constraint:OnDelete:CASCADE"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
 	// Clients are transient/in-memory, not stored in DB
 }
 
+// SessionFile is a file of a session's project
+type SessionFile struct {
+	SessionID string    `json:"-" gorm:"primaryKey"`
+	Path      string    `json:"path" gorm:"primaryKey"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SessionMember is a user's role in a session: "owner", "interviewer",
+// "candidate" or "observer"
+type SessionMember struct {
+	SessionID string `json:"-" gorm:"primaryKey"`
+	UserID    string `json:"userId" gorm:"primaryKey"`
+	UserName  string `json:"userName"`
+	Role      string `json:"role" gorm:"not null"`
+	// InviteID is the invite the user joined with, if the owner did not
+	// give them their role. Revoking it removes them.
+	InviteID  string    `json:"inviteId,omitempty" gorm:"index"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Invite lets whoever holds its link join a session with a role until it
+// expires or is revoked. Its token is not stored.
+type Invite struct {
+	ID        string     `json:"id" gorm:"primaryKey"`
+	SessionID string     `json:"sessionId" gorm:"index;not null"`
+	Role      string     `json:"role" gorm:"not null"`
+	CreatedBy string     `json:"createdBy"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// Run is a recorded execution of a session's code, shown as the session's
+// run history.
+type Run struct {
+	ID            string    `json:"runId" gorm:"primaryKey"`
+	SessionID     string    `json:"sessionId" gorm:"index;not null"`
+	UserID        string    `json:"userId"`
+	UserName      string    `json:"userName"`
+	Language      string    `json:"language"`
+	CodeHash      string    `json:"codeHash"`
+	Success       bool      `json:"success"`
+	ExitCode      int       `json:"exitCode"`
+	Stdout        string    `json:"stdout"`
+	Stderr        string    `json:"stderr"`
+	Error         string    `json:"error,omitempty"`
+	LimitExceeded string    `json:"limitExceeded,omitempty"`
+	ExecutionTime int64     `json:"executionTime"`
+	CreatedAt     time.Time `json:"createdAt" gorm:"index"`
+}
+
+// Finish records the outcome of the run.
+func (r *Run) Finish(resp ExecuteResponse) {
+	r.Success = resp.Success
+	r.ExitCode = resp.ExitCode
+	r.Stdout = resp.Stdout
+	r.Stderr = resp.Stderr
+	r.Error = resp.Error
+	r.LimitExceeded = resp.LimitExceeded
+	r.ExecutionTime = resp.ExecutionTime
+}
+
+// BackplaneMessage holds a WebSocket backplane event too large for a Postgres
+// NOTIFY payload; the notification carries its ID instead.
+type BackplaneMessage struct {
+	ID        uint      `gorm:"primaryKey"`
+	Payload   string    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
 // Client interface (unchanged)
 type Client interface {
 	WriteJSON(v interface{}) error
@@ -32,6 +113,49 @@ type CreateSessionRequest struct {
 	Language string `json:"language,omitempty"`
 }
 
+// UnsupportedLanguageResponse is the error returned for a language the
+// executor cannot run
+type UnsupportedLanguageResponse struct {
+	Error              string   `json:"error"`
+	SupportedLanguages []string `json:"supportedLanguages"`
+}
+
+// AddMemberRequest is the payload for giving a user a role in a session
+type AddMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// CreateInviteRequest is the payload for inviting people to a session
+type CreateInviteRequest struct {
+	Role string `json:"role"`
+	// ExpiresIn is how many seconds the invite is valid for.
+	ExpiresIn int `json:"expiresIn"`
+}
+
+// CreateInviteResponse is the response after creating an invite
+type CreateInviteResponse struct {
+	Invite
+	Token string `json:"token"`
+	// Link is the path of the frontend that joins the session with the
+	// invite.
+	Link string `json:"link"`
+}
+
+// JoinAsGuestRequest is the payload for joining a session with an invite but
+// without an account
+type JoinAsGuestRequest struct {
+	Invite string `json:"invite"`
+	Name   string `json:"name"`
+}
+
+// JoinAsGuestResponse is the response after joining a session as a guest
+type JoinAsGuestResponse struct {
+	AuthResponse
+	SessionID string `json:"sessionId"`
+	Role      string `json:"role"`
+}
+
 // CreateSessionResponse is the response after creating a session
 type CreateSessionResponse struct {
 	SessionID string `json:"sessionId"`
@@ -41,14 +165,77 @@ type CreateSessionResponse struct {
 type ExecuteRequest struct {
 	Code     string `json:"code"`
 	Language string `json:"language"`
+	// Entrypoint is the path Code is run from, and Files the program's
+	// other files by path.
+	Entrypoint string            `json:"entrypoint,omitempty"`
+	Files      map[string]string `json:"files,omitempty"`
+	// Stdin is the program's standard input, and Args its arguments.
+	Stdin string   `json:"stdin,omitempty"`
+	Args  []string `json:"args,omitempty"`
+	// SessionID, if set, shares the run and its result with the session's
+	// participants and records it in the session's run history.
+	SessionID string `json:"sessionId,omitempty"`
 }
 
 // ExecuteResponse is the result of code execution
 type ExecuteResponse struct {
-	Success       bool   `json:"success"`
-	Output        string `json:"output"`
-	Error         string `json:"error,omitempty"`
-	ExecutionTime int64  `json:"executionTime"` // in milliseconds
+	Success  bool   `json:"success"`
+	Output   string `json:"output"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+	// LimitExceeded names the limit that stopped the program: "time",
+	// "memory", "calls" or "output".
+	LimitExceeded string `json:"limitExceeded,omitempty"`
+	// Diagnostics are the compile errors of a program that did not build.
+	Diagnostics   []Diagnostic `json:"diagnostics,omitempty"`
+	ExecutionTime int64        `json:"executionTime"` // in milliseconds
+}
+
+// TestCase is an input to a program and the output expected for it
+type TestCase struct {
+	Stdin          string `json:"stdin"`
+	ExpectedOutput string `json:"expectedOutput"`
+	// Timeout bounds the case, in milliseconds. It defaults to, and cannot
+	// exceed, the timeout of an execution.
+	Timeout int64 `json:"timeout,omitempty"`
+}
+
+// ExecuteTestsRequest is the payload for running code against test cases
+type ExecuteTestsRequest struct {
+	Code       string            `json:"code"`
+	Language   string            `json:"language"`
+	Entrypoint string            `json:"entrypoint,omitempty"`
+	Files      map[string]string `json:"files,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	Tests      []TestCase        `json:"tests"`
+}
+
+// TestResult is the outcome of one test case
+type TestResult struct {
+	ExecuteResponse
+	Passed bool `json:"passed"`
+	// Diff shows how the output differs from the expected output, line by
+	// line, when it does.
+	Diff string `json:"diff,omitempty"`
+}
+
+// ExecuteTestsResponse is the result of running code against test cases,
+// with one result per case in the order they were given
+type ExecuteTestsResponse struct {
+	Passed        int          `json:"passed"`
+	Total         int          `json:"total"`
+	Results       []TestResult `json:"results"`
+	ExecutionTime int64        `json:"executionTime"` // in milliseconds
+}
+
+// Diagnostic is a compiler error pointing at a place in the source
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
 }
 
 // AuthRequest represents login/register payload
@@ -59,7 +246,36 @@ type AuthRequest struct {
 
 // AuthResponse represents the response after successful login
 type AuthResponse struct {
-	Token    string `json:"token"`
-	UserID   string `json:"userId"`
-	Username string `json:"username"`
+	Token string `json:"token"`
+	// ExpiresIn is how many seconds Token is valid for.
+	ExpiresIn int `json:"expiresIn,omitempty"`
+	// RefreshToken gets a new token through POST /token/refresh. It can be
+	// used once.
+	RefreshToken string `json:"refreshToken,omitempty"`
+	UserID       string `json:"userId"`
+	Username     string `json:"username"`
+}
+
+// RefreshRequest is the payload of POST /token/refresh and POST /logout
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// RefreshToken is a refresh token a user was given, stored by its hash. A
+// refresh revokes it and hands out the next one of its family; a revoked
+// token used again has leaked, and revokes the whole family.
+type RefreshToken struct {
+	Hash      string    `gorm:"primaryKey"`
+	FamilyID  string    `gorm:"index;not null"`
+	UserID    string    `gorm:"index;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+// RevokedToken is a token revoked before it expires, by its ID. It can be
+// forgotten once the token expires.
+type RevokedToken struct {
+	ID        string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index"`
 }
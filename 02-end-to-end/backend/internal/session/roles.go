@@ -0,0 +1,58 @@
+package session
+
+// Roles of the members of a session.
+const (
+	// RoleOwner created the session. There is one, and only they can
+	// change who else is a member.
+	RoleOwner = "owner"
+
+	// RoleInterviewer runs the interview alongside the owner.
+	RoleInterviewer = "interviewer"
+
+	// RoleCandidate writes and runs code, but can't change the language.
+	RoleCandidate = "candidate"
+
+	// RoleObserver follows along without changing anything.
+	RoleObserver = "observer"
+)
+
+// Actions a role may allow.
+const (
+	// ActionView is reading the session and following it live.
+	ActionView = "view"
+
+	// ActionEdit is changing the files.
+	ActionEdit = "edit"
+
+	// ActionRun is running the code, or cancelling a run.
+	ActionRun = "run"
+
+	// ActionConfigure is changing the language.
+	ActionConfigure = "configure"
+
+	// ActionManage is giving users roles in the session.
+	ActionManage = "manage"
+)
+
+var permissions = map[string][]string{
+	RoleOwner:       {ActionView, ActionEdit, ActionRun, ActionConfigure, ActionManage},
+	RoleInterviewer: {ActionView, ActionEdit, ActionRun, ActionConfigure},
+	RoleCandidate:   {ActionView, ActionEdit, ActionRun},
+	RoleObserver:    {ActionView},
+}
+
+// ValidRole reports whether role is one of the roles.
+func ValidRole(role string) bool {
+	_, ok := permissions[role]
+	return ok
+}
+
+// Can reports whether role allows action.
+func Can(role, action string) bool {
+	for _, allowed := range permissions[role] {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
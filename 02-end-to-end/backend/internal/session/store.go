@@ -2,36 +2,40 @@ package session
 
 import (
 	"log"
+	"time"
 
 	"backend/internal/db"
+	"backend/internal/languages"
 	"backend/internal/models"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Store manages sessions in database
-type Store struct{}
+type Store struct {
+	// Languages name the entrypoint of sessions created before sessions
+	// had files. The built-in languages are used if it is nil.
+	Languages *languages.Registry
+}
 
 func NewStore() *Store {
 	return &Store{}
 }
 
-func (s *Store) CreateSession(language string) *models.Session {
-	// Default code templates
-	defaultCode := ""
-	switch language {
-	case "javascript":
-		defaultCode = "// JavaScript Example\nconsole.log(\"Hello World\");"
-	case "python":
-		defaultCode = "# Python Example\nprint(\"Hello World\")"
-	case "go":
-		defaultCode = "// Go Example\npackage main\nimport \"fmt\"\nfunc main() {\n\tfmt.Println(\"Hello World\")\n}"
-	}
-
+// CreateSession starts a session owned by owner in language with a single
+// file, the entrypoint, holding code, usually the language's template.
+func (s *Store) CreateSession(owner models.SessionMember, language, entrypoint, code string) *models.Session {
+	owner.Role = RoleOwner
 	session := &models.Session{
-		ID:       uuid.New().String(),
-		Language: language,
-		Code:     defaultCode,
+		ID:         uuid.New().String(),
+		OwnerID:    owner.UserID,
+		Language:   language,
+		Code:       code,
+		Entrypoint: entrypoint,
+		Files:      []models.SessionFile{{Path: entrypoint, Content: code}},
+		Members:    []models.SessionMember{owner},
 	}
 
 	result := db.GetDB().Create(session)
@@ -43,19 +47,231 @@ func (s *Store) CreateSession(language string) *models.Session {
 	return session
 }
 
+// GetSession returns a session with its files, ordered by path.
 func (s *Store) GetSession(id string) (*models.Session, bool) {
 	var session models.Session
-	result := db.GetDB().First(&session, "id = ?", id)
+	result := db.GetDB().
+		Preload("Files", func(tx *gorm.DB) *gorm.DB { return tx.Order("path") }).
+		First(&session, "id = ?", id)
 	if result.Error != nil {
 		return nil, false
 	}
+	if len(session.Files) == 0 {
+		s.addEntrypoint(&session)
+	}
 	return &session, true
 }
 
-func (s *Store) UpdateCode(id, code string) {
-	db.GetDB().Model(&models.Session{}).Where("id = ?", id).Update("code", code)
+// addEntrypoint gives a session created before sessions had files one
+// holding its code.
+func (s *Store) addEntrypoint(session *models.Session) {
+	if session.Entrypoint == "" {
+		registry := s.Languages
+		if registry == nil {
+			registry = languages.Default()
+		}
+		session.Entrypoint = "main"
+		if lang, ok := registry.Get(session.Language); ok {
+			session.Entrypoint = lang.DefaultEntrypoint()
+		}
+	}
+	file := models.SessionFile{SessionID: session.ID, Path: session.Entrypoint, Content: session.Code}
+	session.Files = []models.SessionFile{file}
+
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&file).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).Where("id = ?", session.ID).Update("entrypoint", session.Entrypoint).Error
+	})
+	if err != nil {
+		log.Printf("Failed to add entrypoint to session %s: %v", session.ID, err)
+	}
+}
+
+// SaveFile writes a file of a session, creating it if it doesn't exist.
+func (s *Store) SaveFile(id, path, content string) {
+	file := &models.SessionFile{SessionID: id, Path: path, Content: content}
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(file).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).
+			Where("id = ? AND entrypoint = ?", id, path).
+			Update("code", content).Error
+	})
+	if err != nil {
+		log.Printf("Failed to save %s of session %s: %v", path, id, err)
+	}
+}
+
+// DeleteFile removes a file from a session.
+func (s *Store) DeleteFile(id, path string) {
+	result := db.GetDB().Delete(&models.SessionFile{}, "session_id = ? AND path = ?", id, path)
+	if result.Error != nil {
+		log.Printf("Failed to delete %s of session %s: %v", path, id, result.Error)
+	}
+}
+
+// UpdateEntrypoint makes one of a session's files the one that is run.
+func (s *Store) UpdateEntrypoint(id, path string) {
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var file models.SessionFile
+		if err := tx.First(&file, "session_id = ? AND path = ?", id, path).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Session{}).Where("id = ?", id).Updates(map[string]interface{}{
+			"entrypoint": path,
+			"code":       file.Content,
+		}).Error
+	})
+	if err != nil {
+		log.Printf("Failed to change the entrypoint of session %s to %s: %v", id, path, err)
+	}
 }
 
 func (s *Store) UpdateLanguage(id, language string) {
 	db.GetDB().Model(&models.Session{}).Where("id = ?", id).Update("language", language)
 }
+
+// Role returns the role of a user in a session, and false if the user is not
+// a member. A session created before sessions had members can only be
+// viewed until someone claims it.
+func (s *Store) Role(sessionID, userID string) (string, bool) {
+	var session models.Session
+	if err := db.GetDB().Select("id", "owner_id").First(&session, "id = ?", sessionID).Error; err != nil {
+		return "", false
+	}
+	if session.OwnerID == "" {
+		return RoleObserver, true
+	}
+
+	var member models.SessionMember
+	if err := db.GetDB().First(&member, "session_id = ? AND user_id = ?", sessionID, userID).Error; err != nil {
+		return "", false
+	}
+	return member.Role, true
+}
+
+// ClaimSession makes owner the owner of a session created before sessions had
+// owners, unless someone claimed it first. It reports whether they did.
+// Only someone who took part in the session should claim it; see Ran.
+func (s *Store) ClaimSession(sessionID string, owner models.SessionMember) (bool, error) {
+	owner.SessionID = sessionID
+	owner.Role = RoleOwner
+	var claimed bool
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		// The column was added to existing sessions without a value.
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND (owner_id = '' OR owner_id IS NULL)", sessionID).
+			Update("owner_id", owner.UserID)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		claimed = true
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&owner).Error
+	})
+	if err != nil {
+		return false, err
+	}
+	return claimed, nil
+}
+
+// SetMember gives a user a role in a session, replacing any role they had.
+func (s *Store) SetMember(sessionID string, member models.SessionMember) error {
+	member.SessionID = sessionID
+	return db.GetDB().Clauses(clause.OnConflict{UpdateAll: true}).Create(&member).Error
+}
+
+// RemoveMember takes a user's role in a session away.
+func (s *Store) RemoveMember(sessionID, userID string) error {
+	return db.GetDB().Delete(&models.SessionMember{}, "session_id = ? AND user_id = ?", sessionID, userID).Error
+}
+
+// ListMembers returns the members of a session, oldest first.
+func (s *Store) ListMembers(sessionID string) ([]models.SessionMember, error) {
+	members := []models.SessionMember{}
+	result := db.GetDB().Where("session_id = ?", sessionID).Order("created_at").Find(&members)
+	return members, result.Error
+}
+
+// CreateInvite records an invite to a session.
+func (s *Store) CreateInvite(invite *models.Invite) error {
+	return db.GetDB().Create(invite).Error
+}
+
+// GetInvite returns an invite to a session that can still be used: one that
+// has neither expired nor been revoked.
+func (s *Store) GetInvite(sessionID, id string) (*models.Invite, bool) {
+	var invite models.Invite
+	result := db.GetDB().
+		Where("id = ? AND session_id = ? AND revoked_at IS NULL AND expires_at > ?", id, sessionID, time.Now()).
+		First(&invite)
+	if result.Error != nil {
+		return nil, false
+	}
+	return &invite, true
+}
+
+// ListInvites returns the invites to a session that can still be used,
+// newest first.
+func (s *Store) ListInvites(sessionID string) ([]models.Invite, error) {
+	invites := []models.Invite{}
+	result := db.GetDB().
+		Where("session_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, time.Now()).
+		Order("created_at DESC").
+		Find(&invites)
+	return invites, result.Error
+}
+
+// RevokeInvite stops an invite to a session from being used, and removes the
+// members who joined with it. It reports whether there was such an invite to
+// revoke, and returns the users removed.
+func (s *Store) RevokeInvite(sessionID, id string) (bool, []string, error) {
+	var revoked bool
+	var removed []string
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Invite{}).
+			Where("id = ? AND session_id = ? AND revoked_at IS NULL", id, sessionID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		revoked = true
+
+		members := tx.Where("session_id = ? AND invite_id = ?", sessionID, id)
+		if err := members.Model(&models.SessionMember{}).Pluck("user_id", &removed).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.SessionMember{}, "session_id = ? AND invite_id = ?", sessionID, id).Error
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return revoked, removed, nil
+}
+
+// RecordRun adds a run to its session's history.
+func (s *Store) RecordRun(run *models.Run) {
+	if result := db.GetDB().Create(run); result.Error != nil {
+		log.Printf("Failed to record run %s of session %s: %v", run.ID, run.SessionID, result.Error)
+	}
+}
+
+// Ran reports whether a user has run code in a session.
+func (s *Store) Ran(sessionID, userID string) bool {
+	var count int64
+	db.GetDB().Model(&models.Run{}).Where("session_id = ? AND user_id = ?", sessionID, userID).Count(&count)
+	return count > 0
+}
+
+// ListRuns returns a session's most recent runs, newest first.
+func (s *Store) ListRuns(sessionID string, limit int) ([]models.Run, error) {
+	runs := []models.Run{}
+	result := db.GetDB().
+		Where("session_id = ?", sessionID).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&runs)
+	return runs, result.Error
+}
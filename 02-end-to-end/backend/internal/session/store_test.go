@@ -4,6 +4,7 @@ import (
 	"backend/internal/db"
 	"backend/internal/models"
 	"testing"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -14,14 +15,17 @@ func setupTestDB() {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	d.AutoMigrate(&models.Session{})
+	d.AutoMigrate(&models.Session{}, &models.SessionFile{}, &models.SessionMember{}, &models.Invite{}, &models.Run{})
 	db.DB = d
 }
 
+// owner creates the sessions of the tests.
+var owner = models.SessionMember{UserID: "owner", UserName: "Owner"}
+
 func TestCreateSession(t *testing.T) {
 	setupTestDB()
 	store := NewStore()
-	session := store.CreateSession("python")
+	session := store.CreateSession(owner, "python", "main.py", "print(1)")
 
 	if session.ID == "" {
 		t.Errorf("Expected non-empty session ID")
@@ -31,14 +35,19 @@ func TestCreateSession(t *testing.T) {
 		t.Errorf("Expected language python, got %s", session.Language)
 	}
 
-	if session.Code == "" {
-		t.Errorf("Expected default code for python")
+	if session.Code != "print(1)" {
+		t.Errorf("Expected the session to start with the given code, got %q", session.Code)
+	}
+
+	stored, _ := store.GetSession(session.ID)
+	if stored.Entrypoint != "main.py" || len(stored.Files) != 1 || stored.Files[0].Path != "main.py" || stored.Files[0].Content != "print(1)" {
+		t.Errorf("Expected the code in the entrypoint, got %+v", stored)
 	}
 }
 
 func TestGetSession(t *testing.T) {
 	store := NewStore()
-	session := store.CreateSession("javascript")
+	session := store.CreateSession(owner, "javascript", "main.js", "")
 
 	retrieved, ok := store.GetSession(session.ID)
 	if !ok {
@@ -52,13 +61,13 @@ func TestGetSession(t *testing.T) {
 
 func TestUpdateSession(t *testing.T) {
 	store := NewStore()
-	session := store.CreateSession("javascript")
+	session := store.CreateSession(owner, "javascript", "main.js", "")
 
 	newCode := "console.log('updated')"
-	store.UpdateCode(session.ID, newCode)
+	store.SaveFile(session.ID, "main.js", newCode)
 
 	updated, _ := store.GetSession(session.ID)
-	if updated.Code != newCode {
+	if updated.Code != newCode || updated.Files[0].Content != newCode {
 		t.Errorf("Expected code to be updated")
 	}
 
@@ -68,3 +77,184 @@ func TestUpdateSession(t *testing.T) {
 		t.Errorf("Expected language to be updated")
 	}
 }
+
+func TestSessionFiles(t *testing.T) {
+	store := NewStore()
+	session := store.CreateSession(owner, "python", "main.py", "import utils")
+
+	store.SaveFile(session.ID, "utils.py", "x = 1")
+	store.SaveFile(session.ID, "lib/helpers.py", "y = 2")
+	store.DeleteFile(session.ID, "lib/helpers.py")
+
+	updated, _ := store.GetSession(session.ID)
+	if len(updated.Files) != 2 || updated.Files[0].Path != "main.py" || updated.Files[1].Path != "utils.py" {
+		t.Fatalf("Unexpected files %+v", updated.Files)
+	}
+	if updated.Code != "import utils" {
+		t.Errorf("Saving another file changed the code to %q", updated.Code)
+	}
+
+	store.UpdateEntrypoint(session.ID, "utils.py")
+	updated, _ = store.GetSession(session.ID)
+	if updated.Entrypoint != "utils.py" || updated.Code != "x = 1" {
+		t.Errorf("Expected utils.py to be run, got %q with code %q", updated.Entrypoint, updated.Code)
+	}
+}
+
+func TestSessionWithoutFiles(t *testing.T) {
+	store := NewStore()
+	// A session created before sessions had files.
+	old := &models.Session{ID: "legacy", Language: "go", Code: "package main"}
+	db.GetDB().Create(old)
+
+	session, _ := store.GetSession("legacy")
+	if session.Entrypoint != "main.go" || len(session.Files) != 1 || session.Files[0].Content != "package main" {
+		t.Fatalf("Expected the code in main.go, got %+v", session)
+	}
+
+	// It keeps the file once edited.
+	store.SaveFile("legacy", "main.go", "package main // edited")
+	session, _ = store.GetSession("legacy")
+	if session.Code != "package main // edited" || len(session.Files) != 1 {
+		t.Errorf("Unexpected session %+v", session)
+	}
+}
+
+func TestRunHistory(t *testing.T) {
+	store := NewStore()
+	session := store.CreateSession(owner, "python", "main.py", "")
+	other := store.CreateSession(owner, "python", "main.py", "")
+
+	start := time.Now()
+	for i, id := range []string{"run-1", "run-2", "run-3"} {
+		store.RecordRun(&models.Run{ID: id, SessionID: session.ID, CreatedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	store.RecordRun(&models.Run{ID: "run-other", SessionID: other.ID})
+
+	runs, err := store.ListRuns(session.ID, 2)
+	if err != nil {
+		t.Fatalf("ListRuns failed: %v", err)
+	}
+	if len(runs) != 2 || runs[0].ID != "run-3" || runs[1].ID != "run-2" {
+		t.Errorf("Expected the 2 most recent runs, newest first, got %+v", runs)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	store := NewStore()
+	session := store.CreateSession(owner, "python", "main.py", "")
+
+	if role, ok := store.Role(session.ID, "owner"); !ok || role != RoleOwner {
+		t.Errorf("Expected the creator to own the session, got %q", role)
+	}
+	if _, ok := store.Role(session.ID, "stranger"); ok {
+		t.Errorf("Expected a stranger not to be a member")
+	}
+
+	store.SetMember(session.ID, models.SessionMember{UserID: "cand", UserName: "Cand", Role: RoleObserver})
+	store.SetMember(session.ID, models.SessionMember{UserID: "cand", UserName: "Cand", Role: RoleCandidate})
+	if role, _ := store.Role(session.ID, "cand"); role != RoleCandidate {
+		t.Errorf("Expected the candidate's new role, got %q", role)
+	}
+	members, _ := store.ListMembers(session.ID)
+	if len(members) != 2 || members[0].UserID != "owner" {
+		t.Errorf("Unexpected members %+v", members)
+	}
+
+	store.RemoveMember(session.ID, "cand")
+	if _, ok := store.Role(session.ID, "cand"); ok {
+		t.Errorf("Expected the candidate to be removed")
+	}
+
+	// Sessions from before sessions had owners can only be viewed until
+	// someone claims them.
+	db.GetDB().Create(&models.Session{ID: "ownerless"})
+	if role, _ := store.Role("ownerless", "first"); role != RoleObserver {
+		t.Errorf("Expected an unclaimed session to be read-only, got %q", role)
+	}
+	if claimed, err := store.ClaimSession("ownerless", models.SessionMember{UserID: "first", UserName: "First"}); !claimed || err != nil {
+		t.Fatalf("Expected the session to be claimed, got %v, %v", claimed, err)
+	}
+	if claimed, _ := store.ClaimSession("ownerless", models.SessionMember{UserID: "second", UserName: "Second"}); claimed {
+		t.Error("Expected a claimed session not to be claimed again")
+	}
+	if role, _ := store.Role("ownerless", "first"); role != RoleOwner {
+		t.Errorf("Expected the first to claim it to own it, got %q", role)
+	}
+	if _, ok := store.Role("ownerless", "second"); ok {
+		t.Error("Expected the second to claim it to have no role")
+	}
+
+	store.RecordRun(&models.Run{ID: "run-first", SessionID: "ownerless", UserID: "first"})
+	if !store.Ran("ownerless", "first") || store.Ran("ownerless", "second") {
+		t.Error("Expected only the first to have run code in the session")
+	}
+}
+
+func TestRoles(t *testing.T) {
+	if Can(RoleObserver, ActionEdit) || !Can(RoleObserver, ActionView) {
+		t.Errorf("Observers can only follow along")
+	}
+	if Can(RoleCandidate, ActionConfigure) || !Can(RoleCandidate, ActionRun) {
+		t.Errorf("Candidates can run code but not change the language")
+	}
+	if Can(RoleInterviewer, ActionManage) || !Can(RoleOwner, ActionManage) {
+		t.Errorf("Only the owner manages members")
+	}
+	if Can("", ActionView) || ValidRole("admin") {
+		t.Errorf("Unknown roles allow nothing")
+	}
+}
+
+func TestInvites(t *testing.T) {
+	store := NewStore()
+	session := store.CreateSession(owner, "python", "main.py", "")
+
+	for _, invite := range []models.Invite{
+		{ID: "open", Role: RoleCandidate, ExpiresAt: time.Now().Add(time.Hour)},
+		{ID: "expired", Role: RoleCandidate, ExpiresAt: time.Now().Add(-time.Hour)},
+	} {
+		invite.SessionID = session.ID
+		if err := store.CreateInvite(&invite); err != nil {
+			t.Fatalf("CreateInvite failed: %v", err)
+		}
+	}
+
+	if _, ok := store.GetInvite(session.ID, "open"); !ok {
+		t.Errorf("Expected the invite to be usable")
+	}
+	if _, ok := store.GetInvite("other", "open"); ok {
+		t.Errorf("Expected the invite to be for its session only")
+	}
+	if _, ok := store.GetInvite(session.ID, "expired"); ok {
+		t.Errorf("Expected the expired invite not to be usable")
+	}
+	if invites, _ := store.ListInvites(session.ID); len(invites) != 1 || invites[0].ID != "open" {
+		t.Errorf("Unexpected outstanding invites %+v", invites)
+	}
+
+	// Users who joined with the invite lose their role with it; those the
+	// owner gave a role keep it.
+	store.SetMember(session.ID, models.SessionMember{UserID: "joined", Role: RoleCandidate, InviteID: "open"})
+	store.SetMember(session.ID, models.SessionMember{UserID: "added", Role: RoleCandidate})
+
+	revoked, removed, err := store.RevokeInvite(session.ID, "open")
+	if !revoked || err != nil {
+		t.Fatalf("Expected the invite to be revoked, got %v %v", revoked, err)
+	}
+	if _, ok := store.GetInvite(session.ID, "open"); ok {
+		t.Errorf("Expected the revoked invite not to be usable")
+	}
+	if len(removed) != 1 || removed[0] != "joined" {
+		t.Errorf("Expected the user who joined with the invite to be removed, got %v", removed)
+	}
+	if _, ok := store.Role(session.ID, "joined"); ok {
+		t.Errorf("Expected the user who joined with the invite not to be a member")
+	}
+	if role, _ := store.Role(session.ID, "added"); role != RoleCandidate {
+		t.Errorf("Expected the user the owner added to keep their role, got %q", role)
+	}
+	if revoked, _, _ := store.RevokeInvite(session.ID, "open"); revoked {
+		t.Errorf("Expected an invite to be revoked once")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"backend/internal/db"
 	"backend/internal/models"
 	"testing"
+	"time"
 
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -14,7 +15,7 @@ func setupTestDB() {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	d.AutoMigrate(&models.User{})
+	d.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.RevokedToken{})
 	db.DB = d
 }
 
@@ -59,3 +60,57 @@ func TestGetUser(t *testing.T) {
 		t.Errorf("GetUserByUsername succeeded for nonexistent user")
 	}
 }
+
+func TestRefreshTokenRotation(t *testing.T) {
+	setupTestDB()
+	store := NewStore()
+	user, _ := store.CreateUser("refresher", "hashedpass")
+
+	first, err := store.CreateRefreshToken(user.ID)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken failed: %v", err)
+	}
+	second, refreshed, err := store.RotateRefreshToken(first)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken failed: %v", err)
+	}
+	if refreshed.ID != user.ID || second == first {
+		t.Errorf("Expected a new token for %s, got %q for %+v", user.ID, second, refreshed)
+	}
+
+	// A token can be used once; using it again revokes its family.
+	if _, _, err := store.RotateRefreshToken(first); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected a used token to be refused, got %v", err)
+	}
+	if _, _, err := store.RotateRefreshToken(second); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected the family of a reused token to be revoked, got %v", err)
+	}
+
+	third, _ := store.CreateRefreshToken(user.ID)
+	store.RevokeRefreshToken(third)
+	if _, _, err := store.RotateRefreshToken(third); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected a revoked token to be refused, got %v", err)
+	}
+	if _, _, err := store.RotateRefreshToken("unknown"); err != ErrInvalidRefreshToken {
+		t.Errorf("Expected an unknown token to be refused, got %v", err)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	setupTestDB()
+	store := NewStore()
+
+	store.RevokeToken("expired", time.Now().Add(-time.Minute))
+	store.RevokeToken("jti", time.Now().Add(time.Minute))
+	if !store.IsTokenRevoked("jti") {
+		t.Errorf("Expected the token to be revoked")
+	}
+	if store.IsTokenRevoked("other") || store.IsTokenRevoked("") {
+		t.Errorf("Expected other tokens not to be revoked")
+	}
+
+	// Revoked tokens are forgotten once they expire.
+	if store.IsTokenRevoked("expired") {
+		t.Errorf("Expected the expired token to be forgotten")
+	}
+}
@@ -0,0 +1,121 @@
+package users
+
+import (
+	"errors"
+	"time"
+
+	"backend/internal/auth"
+	"backend/internal/db"
+	"backend/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// RefreshTokenExpiry is how long a refresh token can be used. Each refresh
+// starts it over, so a user who keeps coming back stays signed in.
+const RefreshTokenExpiry = 30 * 24 * time.Hour
+
+// ErrInvalidRefreshToken refuses a refresh token that is unknown, expired or
+// revoked.
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// CreateRefreshToken starts a family of refresh tokens for a user signing in,
+// and returns its first token.
+func (s *Store) CreateRefreshToken(userID string) (string, error) {
+	return createRefreshToken(db.GetDB(), userID, uuid.New().String())
+}
+
+func createRefreshToken(tx *gorm.DB, userID, familyID string) (string, error) {
+	token, hash, err := auth.GenerateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	result := tx.Create(&models.RefreshToken{
+		Hash:      hash,
+		FamilyID:  familyID,
+		UserID:    userID,
+		ExpiresAt: time.Now().Add(RefreshTokenExpiry),
+	})
+	return token, result.Error
+}
+
+// RotateRefreshToken revokes a refresh token and returns the next one of its
+// family, with the user it belongs to. A token that was already revoked has
+// leaked: the whole family is revoked, signing out whoever holds the latest.
+func (s *Store) RotateRefreshToken(token string) (string, *models.User, error) {
+	var next string
+	var user models.User
+	var reused bool
+	err := db.GetDB().Transaction(func(tx *gorm.DB) error {
+		var current models.RefreshToken
+		if err := tx.First(&current, "hash = ?", auth.HashRefreshToken(token)).Error; err != nil {
+			return ErrInvalidRefreshToken
+		}
+		if current.ExpiresAt.Before(time.Now()) {
+			return ErrInvalidRefreshToken
+		}
+
+		// Of two refreshes racing with the same token, only one revokes it.
+		result := tx.Model(&models.RefreshToken{}).
+			Where("hash = ? AND revoked_at IS NULL", current.Hash).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			reused = true
+			return ErrInvalidRefreshToken
+		}
+
+		if err := tx.First(&user, "id = ?", current.UserID).Error; err != nil {
+			return ErrInvalidRefreshToken
+		}
+		var err error
+		next, err = createRefreshToken(tx, current.UserID, current.FamilyID)
+		return err
+	})
+	if reused {
+		if err := s.RevokeRefreshToken(token); err != nil {
+			return "", nil, err
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return next, &user, nil
+}
+
+// RevokeRefreshToken revokes a refresh token and the others of its family.
+func (s *Store) RevokeRefreshToken(token string) error {
+	var current models.RefreshToken
+	if err := db.GetDB().First(&current, "hash = ?", auth.HashRefreshToken(token)).Error; err != nil {
+		return nil
+	}
+	return db.GetDB().Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", current.FamilyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeToken stops a token from being accepted until it expires, and
+// forgets tokens revoked earlier that have since expired.
+func (s *Store) RevokeToken(id string, expiresAt time.Time) error {
+	if err := db.GetDB().Delete(&models.RevokedToken{}, "expires_at < ?", time.Now()).Error; err != nil {
+		return err
+	}
+	return db.GetDB().Create(&models.RevokedToken{ID: id, ExpiresAt: expiresAt}).Error
+}
+
+// IsTokenRevoked reports whether a token was revoked before it expired.
+// Tokens without an ID, issued before tokens could be revoked, never are.
+func (s *Store) IsTokenRevoked(id string) bool {
+	if id == "" {
+		return false
+	}
+	var count int64
+	if err := db.GetDB().Model(&models.RevokedToken{}).Where("id = ?", id).Count(&count).Error; err != nil {
+		// Better to turn a user away than to let a revoked token in.
+		return true
+	}
+	return count > 0
+}
@@ -0,0 +1,159 @@
+package ws
+
+import (
+	"context"
+	"sync"
+)
+
+// Backplane relays session events between hub instances, so that the
+// participants of a session see one room no matter which backend replica
+// they are connected to. It is also what orders a session's events: every
+// subscriber of a session must receive its events in the same order, and
+// each hub applies them in that order.
+type Backplane interface {
+	// Publish sends an event to every subscriber of the session, including
+	// subscribers on the publishing instance.
+	Publish(ctx context.Context, sessionID string, payload []byte) error
+
+	// Subscribe delivers the session's events to handler, one at a time and
+	// in publish order, until unsubscribe is called. Events the instance
+	// had already received are still delivered; once unsubscribe returns,
+	// handler is not called again.
+	Subscribe(ctx context.Context, sessionID string, handler func(payload []byte)) (unsubscribe func(), err error)
+
+	Close() error
+}
+
+// MemoryBackplane is a Backplane for hubs living in the same process. It is
+// what a standalone hub uses, and lets tests run several hubs side by side.
+type MemoryBackplane struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscription]bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{
+		subs: make(map[string]map[*subscription]bool),
+	}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, sessionID string, payload []byte) error {
+	// Queueing under the lock gives every subscriber the same order.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs[sessionID] {
+		sub.push(payload)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(ctx context.Context, sessionID string, handler func(payload []byte)) (func(), error) {
+	sub := newSubscription(handler)
+
+	b.mu.Lock()
+	if b.subs[sessionID] == nil {
+		b.subs[sessionID] = make(map[*subscription]bool)
+	}
+	b.subs[sessionID][sub] = true
+	b.mu.Unlock()
+
+	return func() {
+		b.mu.Lock()
+		delete(b.subs[sessionID], sub)
+		if len(b.subs[sessionID]) == 0 {
+			delete(b.subs, sessionID)
+		}
+		b.mu.Unlock()
+		sub.stop()
+		sub.wait()
+	}, nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, subs := range b.subs {
+		for sub := range subs {
+			sub.stop()
+		}
+	}
+	b.subs = make(map[string]map[*subscription]bool)
+	return nil
+}
+
+// subscription hands payloads to a handler on its own goroutine, in order.
+// Its queue is unbounded so that publishers never wait on a slow handler.
+type subscription struct {
+	handler func(payload []byte)
+
+	mu     sync.Mutex
+	queue  [][]byte
+	wake   chan struct{}
+	closed bool
+	// exited is closed once the handler has been given everything queued
+	// before stop and won't be called again.
+	exited chan struct{}
+}
+
+func newSubscription(handler func(payload []byte)) *subscription {
+	s := &subscription{
+		handler: handler,
+		wake:    make(chan struct{}, 1),
+		exited:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *subscription) push(payload []byte) {
+	s.mu.Lock()
+	if !s.closed {
+		s.queue = append(s.queue, payload)
+	}
+	s.mu.Unlock()
+	s.signal()
+}
+
+// stop refuses further payloads. Those already queued are still handed to
+// the handler.
+func (s *subscription) stop() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.signal()
+}
+
+// wait returns once the handler has been called for the last time.
+func (s *subscription) wait() {
+	<-s.exited
+}
+
+func (s *subscription) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *subscription) run() {
+	defer close(s.exited)
+
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				closed := s.closed
+				s.mu.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			payload := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.handler(payload)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+package ws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backend/internal/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+const (
+	// maxNotifyPayload keeps payloads under Postgres' 8000 byte NOTIFY limit.
+	// Larger events are stored in a table and only their ID is notified.
+	maxNotifyPayload = 7900
+
+	// spilledMessageTTL is how long stored events are kept for listeners.
+	spilledMessageTTL = 5 * time.Minute
+
+	// listenRetryDelay is how long to wait before reconnecting the listener.
+	listenRetryDelay = 2 * time.Second
+)
+
+// pgChannel is a session's notification channel and its local subscribers.
+type pgChannel struct {
+	subs map[*subscription]bool
+
+	// ready is closed once LISTEN has been issued for the channel.
+	ready     chan struct{}
+	listening bool
+}
+
+// PostgresBackplane relays session events through Postgres LISTEN/NOTIFY.
+// Postgres delivers notifications to every listener in commit order, which
+// gives all instances the same order of events for a session.
+//
+// One dedicated connection listens on a channel per subscribed session;
+// notifications are published through the regular connection pool.
+type PostgresBackplane struct {
+	db         *gorm.DB
+	connString string
+
+	mu         sync.Mutex
+	channels   map[string]*pgChannel
+	cancelWait context.CancelFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewPostgresBackplane connects the listener and starts relaying
+// notifications. database is used for publishing.
+func NewPostgresBackplane(database *gorm.DB, connString string) (*PostgresBackplane, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	conn, err := pgx.Connect(ctx, connString)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("backplane listener: %w", err)
+	}
+
+	b := &PostgresBackplane{
+		db:         database,
+		connString: connString,
+		channels:   make(map[string]*pgChannel),
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go b.listen(conn)
+	return b, nil
+}
+
+func (b *PostgresBackplane) Publish(ctx context.Context, sessionID string, payload []byte) error {
+	message := string(payload)
+	if len(payload) > maxNotifyPayload {
+		stored := &models.BackplaneMessage{Payload: message}
+		if err := b.db.WithContext(ctx).Create(stored).Error; err != nil {
+			return fmt.Errorf("store backplane message: %w", err)
+		}
+		message = "@" + strconv.FormatUint(uint64(stored.ID), 10)
+
+		b.db.WithContext(ctx).
+			Where("created_at < ?", time.Now().Add(-spilledMessageTTL)).
+			Delete(&models.BackplaneMessage{})
+	}
+
+	return b.db.WithContext(ctx).
+		Exec("SELECT pg_notify(?, ?)", channelName(sessionID), message).Error
+}
+
+func (b *PostgresBackplane) Subscribe(ctx context.Context, sessionID string, handler func(payload []byte)) (func(), error) {
+	name := channelName(sessionID)
+	sub := newSubscription(handler)
+
+	b.mu.Lock()
+	ch, ok := b.channels[name]
+	if !ok {
+		ch = &pgChannel{subs: make(map[*subscription]bool), ready: make(chan struct{})}
+		b.channels[name] = ch
+	}
+	ch.subs[sub] = true
+	b.wakeLocked()
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		if ch := b.channels[name]; ch != nil {
+			delete(ch.subs, sub)
+			if len(ch.subs) == 0 {
+				delete(b.channels, name)
+				b.wakeLocked()
+			}
+		}
+		b.mu.Unlock()
+		sub.stop()
+		sub.wait()
+	}
+
+	// Events published before LISTEN is in place would be lost, so don't
+	// return until it is.
+	select {
+	case <-ch.ready:
+		return unsubscribe, nil
+	case <-ctx.Done():
+		unsubscribe()
+		return nil, ctx.Err()
+	case <-b.ctx.Done():
+		unsubscribe()
+		return nil, errors.New("backplane closed")
+	}
+}
+
+func (b *PostgresBackplane) Close() error {
+	b.cancel()
+	<-b.done
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.channels {
+		for sub := range ch.subs {
+			sub.stop()
+		}
+	}
+	return nil
+}
+
+// wakeLocked interrupts the listener's wait so it picks up channel changes.
+func (b *PostgresBackplane) wakeLocked() {
+	if b.cancelWait != nil {
+		b.cancelWait()
+	}
+}
+
+// listen owns the listener connection: it keeps LISTEN in step with the
+// subscribed channels and dispatches notifications, reconnecting on failure.
+func (b *PostgresBackplane) listen(conn *pgx.Conn) {
+	defer close(b.done)
+
+	listened := make(map[string]bool)
+	for {
+		if conn == nil {
+			var err error
+			conn, err = pgx.Connect(b.ctx, b.connString)
+			if err != nil {
+				if b.ctx.Err() != nil {
+					return
+				}
+				log.Printf("Backplane listener failed to connect: %v", err)
+				time.Sleep(listenRetryDelay)
+				continue
+			}
+			// Notifications sent while we were away are lost; rooms
+			// resync as clients rejoin.
+			listened = make(map[string]bool)
+			b.mu.Lock()
+			for _, ch := range b.channels {
+				ch.listening = false
+			}
+			b.mu.Unlock()
+		}
+
+		b.mu.Lock()
+		var toListen, toUnlisten []string
+		for name, ch := range b.channels {
+			if !ch.listening {
+				toListen = append(toListen, name)
+			}
+		}
+		for name := range listened {
+			if b.channels[name] == nil {
+				toUnlisten = append(toUnlisten, name)
+			}
+		}
+		waitCtx, cancel := context.WithCancel(b.ctx)
+		b.cancelWait = cancel
+		b.mu.Unlock()
+
+		err := b.sync(conn, listened, toListen, toUnlisten)
+		if err == nil {
+			var n *pgconn.Notification
+			n, err = conn.WaitForNotification(waitCtx)
+			if err == nil {
+				b.dispatch(n)
+			}
+		}
+		cancel()
+
+		switch {
+		case b.ctx.Err() != nil:
+			conn.Close(context.Background())
+			return
+		case err != nil && waitCtx.Err() == nil:
+			log.Printf("Backplane listener error: %v", err)
+			conn.Close(context.Background())
+			conn = nil
+			time.Sleep(listenRetryDelay)
+		}
+	}
+}
+
+// sync issues LISTEN and UNLISTEN for the channels that changed.
+func (b *PostgresBackplane) sync(conn *pgx.Conn, listened map[string]bool, toListen, toUnlisten []string) error {
+	for _, name := range toListen {
+		if _, err := conn.Exec(b.ctx, "LISTEN "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return err
+		}
+		listened[name] = true
+
+		b.mu.Lock()
+		if ch := b.channels[name]; ch != nil && !ch.listening {
+			ch.listening = true
+			select {
+			case <-ch.ready:
+			default:
+				close(ch.ready)
+			}
+		}
+		b.mu.Unlock()
+	}
+
+	for _, name := range toUnlisten {
+		if _, err := conn.Exec(b.ctx, "UNLISTEN "+pgx.Identifier{name}.Sanitize()); err != nil {
+			return err
+		}
+		delete(listened, name)
+	}
+	return nil
+}
+
+// dispatch hands a notification to the channel's subscribers.
+func (b *PostgresBackplane) dispatch(n *pgconn.Notification) {
+	payload := []byte(n.Payload)
+	if id, ok := strings.CutPrefix(n.Payload, "@"); ok {
+		var stored models.BackplaneMessage
+		if err := b.db.WithContext(b.ctx).First(&stored, "id = ?", id).Error; err != nil {
+			log.Printf("Backplane message %s not found: %v", id, err)
+			return
+		}
+		payload = []byte(stored.Payload)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch := b.channels[n.Channel]; ch != nil {
+		for sub := range ch.subs {
+			sub.push(payload)
+		}
+	}
+}
+
+// channelName maps a session ID to a notification channel. Session IDs come
+// from request paths, so they are hashed rather than used as identifiers.
+func channelName(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return "ws_" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,210 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/models"
+)
+
+func TestMemoryBackplaneOrdersEvents(t *testing.T) {
+	b := NewMemoryBackplane()
+	defer b.Close()
+
+	var mu sync.Mutex
+	received := make([][]string, 2)
+	var wg sync.WaitGroup
+	wg.Add(2 * 100)
+	for i := range received {
+		i := i
+		unsubscribe, err := b.Subscribe(context.Background(), "s1", func(payload []byte) {
+			mu.Lock()
+			received[i] = append(received[i], string(payload))
+			mu.Unlock()
+			wg.Done()
+		})
+		if err != nil {
+			t.Fatalf("Subscribe failed: %v", err)
+		}
+		defer unsubscribe()
+	}
+
+	var publishers sync.WaitGroup
+	for p := 0; p < 4; p++ {
+		publishers.Add(1)
+		go func(p int) {
+			defer publishers.Done()
+			for i := 0; i < 25; i++ {
+				b.Publish(context.Background(), "s1", []byte{byte('a' + p), byte(i)})
+			}
+		}(p)
+	}
+	publishers.Wait()
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range received[0] {
+		if received[0][i] != received[1][i] {
+			t.Fatalf("Subscribers saw different orders at event %d", i)
+		}
+	}
+}
+
+func TestHubsShareSessionsOverBackplane(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "ab", Language: "python"}
+
+	backplane := NewMemoryBackplane()
+	hubA := NewHubWithBackplane(store, backplane)
+	hubB := NewHubWithBackplane(store, backplane)
+	go hubA.Run()
+	go hubB.Run()
+
+	alice := newTestClient(hubA, "s1", "alice")
+	hubA.Register <- alice
+	// Nobody else has the session open, so hub A falls back to the store.
+	if state := decodeState(t, nextMessageWithin(t, alice, "session-state", 3*time.Second)); state.Code != "ab" {
+		t.Fatalf("Expected code from store, got %q", state.Code)
+	}
+
+	alice.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(2).Insert("c")})
+	nextMessage(t, alice, "code-ack")
+	alice.publish(&Event{Type: eventFileCreate, Path: "utils.py", Content: "x = 1"})
+
+	// Bob joins on the other instance and gets the live document from hub A.
+	bob := newTestClient(hubB, "s1", "bob")
+	hubB.Register <- bob
+	state := decodeState(t, nextMessage(t, bob, "session-state"))
+	if state.Code != "abc" || state.Version != 1 {
+		t.Fatalf("Expected synced document, got %q at version %d", state.Code, state.Version)
+	}
+	if len(state.Files) != 2 || state.Files[1].Path != "utils.py" {
+		t.Errorf("Expected the files of the session, got %+v", state.Files)
+	}
+	if len(state.Participants) != 2 {
+		t.Errorf("Expected 2 participants across instances, got %d", len(state.Participants))
+	}
+	nextMessage(t, alice, "user-joined")
+
+	bob.publish(&Event{Type: eventEdit, Version: 1, Operation: NewOperation().Insert(">").Retain(3)})
+	nextMessage(t, bob, "code-ack")
+
+	msg := nextMessage(t, alice, "code-update")
+	var update struct {
+		Version   int        `json:"version"`
+		Operation *Operation `json:"operation"`
+		UserID    string     `json:"userId"`
+	}
+	if err := json.Unmarshal(msg.Data, &update); err != nil {
+		t.Fatalf("Invalid code-update: %v", err)
+	}
+	if update.Version != 2 || update.UserID != "bob" {
+		t.Errorf("Unexpected code-update %+v", update)
+	}
+	if text, _ := update.Operation.Apply("abc"); text != ">abc" {
+		t.Errorf("Expected alice to end up with %q, got %q", ">abc", text)
+	}
+}
+
+func TestFlushSessionFromAnotherInstance(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "ab", Language: "python"}
+
+	backplane := NewMemoryBackplane()
+	hubA := NewHubWithBackplane(store, backplane)
+	hubB := NewHubWithBackplane(store, backplane)
+	go hubA.Run()
+	go hubB.Run()
+
+	alice := newTestClient(hubA, "s1", "alice")
+	hubA.Register <- alice
+	nextMessageWithin(t, alice, "session-state", 3*time.Second)
+
+	alice.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(2).Insert("c")})
+	nextMessage(t, alice, "code-ack")
+
+	// Hub B doesn't have the session open; hub A saves it for it.
+	hubB.FlushSession("s1")
+	if s, _ := store.GetSession("s1"); s.Code != "abc" {
+		t.Errorf("Expected the edit to be saved, got %q", s.Code)
+	}
+
+	// Nobody has s2 open, so there is nothing to wait for.
+	start := time.Now()
+	hubB.FlushSession("s2")
+	if elapsed := time.Since(start); elapsed > 2*flushTimeout {
+		t.Errorf("Flushing a session nobody has open took %v", elapsed)
+	}
+}
+
+func TestSessionSavedByOneInstance(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "ab", Language: "python"}
+
+	backplane := NewMemoryBackplane()
+	hubA := NewHubWithBackplane(store, backplane)
+	hubB := NewHubWithBackplane(store, backplane)
+	hubA.persist.delay = 100 * time.Millisecond
+	hubB.persist.delay = 100 * time.Millisecond
+	go hubA.Run()
+	go hubB.Run()
+
+	alice := newTestClient(hubA, "s1", "alice")
+	hubA.Register <- alice
+	nextMessageWithin(t, alice, "session-state", 3*time.Second)
+	bob := newTestClient(hubB, "s1", "bob")
+	hubB.Register <- bob
+	nextMessage(t, bob, "session-state")
+
+	alice.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(2).Insert("c")})
+	nextMessage(t, alice, "code-ack")
+	bob.publish(&Event{Type: eventEdit, Version: 1, Operation: NewOperation().Retain(3).Insert("d")})
+	nextMessage(t, bob, "code-ack")
+	nextMessage(t, alice, "code-update")
+
+	time.Sleep(500 * time.Millisecond)
+	if writes := store.writes(); writes != 1 {
+		t.Errorf("Expected the edits to be written once, got %d writes", writes)
+	}
+	if s, _ := store.GetSession("s1"); s.Code != "abcd" {
+		t.Errorf("Expected both edits to be saved, got %q", s.Code)
+	}
+
+	// Whichever instance saved the session, the other one takes over when
+	// alice leaves.
+	hubA.Unregister <- alice
+	nextMessage(t, bob, "user-left")
+	bob.publish(&Event{Type: eventEdit, Version: 2, Operation: NewOperation().Retain(4).Insert("e")})
+	nextMessage(t, bob, "code-ack")
+	hubA.FlushSession("s1")
+	if s, _ := store.GetSession("s1"); s.Code != "abcde" {
+		t.Errorf("Expected the edit after the handover to be saved, got %q", s.Code)
+	}
+}
+
+// nextMessageWithin is nextMessage with a custom timeout.
+func nextMessageWithin(t *testing.T, c *Client, msgType string, timeout time.Duration) testMessage {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case raw, ok := <-c.SendChan:
+			if !ok {
+				t.Fatalf("Send channel of %s closed waiting for %s", c.UserID, msgType)
+			}
+			var msg testMessage
+			if err := json.Unmarshal(raw, &msg); err != nil {
+				t.Fatalf("Invalid message %s: %v", raw, err)
+			}
+			if msg.Type == msgType {
+				return msg
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for %s on %s", msgType, c.UserID)
+		}
+	}
+}
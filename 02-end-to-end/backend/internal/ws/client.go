@@ -2,11 +2,16 @@ package ws
 
 import (
 	"encoding/json"
+	"hash/fnv"
 
 	"log"
 	"net/http"
 	"time"
 
+	"backend/internal/auth"
+	"backend/internal/executor"
+	"backend/internal/models"
+
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
@@ -21,10 +26,17 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum message size allowed from peer. Edits carry the inserted text,
+	// so this has to fit a pasted file.
+	maxMessageSize = 64 * 1024
 )
 
+// userColors are the presence colors handed out to users.
+var userColors = []string{
+	"#f87171", "#fb923c", "#facc15", "#4ade80",
+	"#22d3ee", "#60a5fa", "#a78bfa", "#f472b6",
+}
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -44,11 +56,57 @@ type Client struct {
 	// Buffered channel of outbound messages.
 	SendChan chan []byte
 
+	// ConnID identifies this connection. A user with the session open in
+	// several tabs has one client per tab, all sharing the same UserID.
+	ConnID string
+
 	// User info
 	UserID    string
 	UserName  string
 	UserColor string
 	SessionID string
+
+	// Role is the user's role in the session, which decides what the room
+	// lets them do.
+	Role string
+
+	// Guest is set for someone without an account, who joined with the
+	// invite InviteID.
+	Guest    bool
+	InviteID string
+}
+
+// inboundMessage is a message received from a client. Only Type is always
+// set; the other fields belong to specific message types.
+type inboundMessage struct {
+	Type string `json:"type"`
+
+	// code-update: the file, the operation and the version of the file it
+	// is based on. Without a path, the edit is to the entrypoint.
+	Path      string     `json:"path"`
+	Version   int        `json:"version"`
+	Operation *Operation `json:"operation"`
+
+	// file-create: the file's path and initial content. file-rename: its
+	// path and the new one. file-delete, entrypoint-change: its path.
+	NewPath string `json:"newPath"`
+	Content string `json:"content"`
+
+	// language-change: the new language of the session.
+	Language string `json:"language"`
+
+	// cursor-move: the client's cursor position, opaque to the server.
+	Cursor json.RawMessage `json:"cursor"`
+
+	// run-cancel: the run to cancel; the current one if empty.
+	RunID string `json:"runId"`
+
+	// run, run-tests: the program's standard input and arguments.
+	Stdin string   `json:"stdin"`
+	Args  []string `json:"args"`
+
+	// run-tests: the test cases to run the program against.
+	Tests []models.TestCase `json:"tests"`
 }
 
 // Send implements the models.Client interface but we use SendChan directly in internal packages
@@ -56,25 +114,27 @@ func (c *Client) Send(msg interface{}) {
 	// Not used in this implementation pattern, using channels
 }
 
-func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, sessionID string) {
+// ServeWs upgrades the request and joins the session as the user the
+// validated token belongs to, with their role in the session.
+func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, sessionID string, claims *auth.Claims, role string) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	// Setup client with random user data for now
-	// In a real app we'd get this from auth context
-	userID := uuid.New().String()
-
 	client := &Client{
 		Hub:       hub,
 		Conn:      conn,
 		SendChan:  make(chan []byte, 256),
-		UserID:    userID,
-		UserName:  "User " + userID[:4], // Simple random name
-		UserColor: "#" + userID[:6],     // Random color
+		ConnID:    uuid.New().String(),
+		UserID:    claims.UserID,
+		UserName:  claims.Username,
+		UserColor: colorFor(claims.UserID),
 		SessionID: sessionID,
+		Role:      role,
+		Guest:     claims.Guest,
+		InviteID:  claims.InviteID,
 	}
 
 	client.Hub.Register <- client
@@ -83,21 +143,34 @@ func ServeWs(hub *Hub, w http.ResponseWriter, r *http.Request, sessionID string)
 	connectedMsg := map[string]interface{}{
 		"type": "connected",
 		"data": map[string]interface{}{
-			"sessionId": sessionID,
-			"userId":    userID,
+			"sessionId":    sessionID,
+			"userId":       client.UserID,
+			"userName":     client.UserName,
+			"connectionId": client.ConnID,
+			"role":         client.Role,
+			"guest":        client.Guest,
 		},
 	}
 	if err := client.Conn.WriteJSON(connectedMsg); err != nil {
 		log.Println("Error sending connected message:", err)
 	}
 
-	// Send "user-joined" for self so frontend knows own identity details used by server
-	// Actually frontend handles 'connected' but might appreciate the user object
+	// The room queues a "session-state" snapshot with the current code and
+	// participants once the join is applied; writePump delivers it after
+	// this message. Until then, this is the only writer on the connection.
 
 	go client.writePump()
 	go client.readPump()
 }
 
+// colorFor picks a stable presence color for a user, so they keep the same
+// color across tabs and reconnects.
+func colorFor(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	return userColors[h.Sum32()%uint32(len(userColors))]
+}
+
 // readPump pumps messages from the websocket connection to the hub.
 func (c *Client) readPump() {
 	defer func() {
@@ -118,30 +191,68 @@ func (c *Client) readPump() {
 		}
 
 		// Parse message to determine type
-		var msg map[string]interface{}
+		var msg inboundMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Println("Invalid JSON:", err)
 			continue
 		}
 
-		msgType, _ := msg["type"].(string)
+		msgType := msg.Type
 
 		switch msgType {
 		case "code-update":
-			// Broadcast to others
-			c.Hub.BroadcastToOthers(message, c)
+			if msg.Operation == nil {
+				log.Println("code-update without operation")
+				continue
+			}
+			// Every instance applies it to the session's file in the
+			// same order and broadcasts the transformed operation.
+			c.publish(&Event{Type: eventEdit, Path: msg.Path, Version: msg.Version, Operation: msg.Operation})
 		case "language-change":
-			// Broadcast to others
-			c.Hub.BroadcastToOthers(message, c)
+			// The room refuses languages that can't be run.
+			c.publish(&Event{Type: eventLanguage, Language: msg.Language})
+		case "file-create":
+			// The room refuses changes to the files that can't be made.
+			c.publish(&Event{Type: eventFileCreate, Path: msg.Path, Content: msg.Content})
+		case "file-rename":
+			c.publish(&Event{Type: eventFileRename, Path: msg.Path, NewPath: msg.NewPath})
+		case "file-delete":
+			c.publish(&Event{Type: eventFileDelete, Path: msg.Path})
+		case "entrypoint-change":
+			c.publish(&Event{Type: eventEntrypoint, Path: msg.Path})
 		case "cursor-move":
-			// Broadcast to others
-			c.Hub.BroadcastToOthers(message, c)
+			if msg.Cursor == nil {
+				log.Println("cursor-move without cursor")
+				continue
+			}
+			c.publish(&Event{Type: eventCursor, Cursor: msg.Cursor})
+		case "run":
+			// Runs the session's files as of when the request reaches the
+			// room, and streams the output to everyone in the session.
+			c.publish(&Event{Type: eventRun, RunID: uuid.New().String(), Stdin: msg.Stdin, Args: msg.Args})
+		case "run-tests":
+			// Like run, but against each test case, and the results are
+			// shared instead of the output.
+			if len(msg.Tests) == 0 || len(msg.Tests) > executor.MaxTestCases {
+				log.Println("run-tests with an invalid number of tests:", len(msg.Tests))
+				continue
+			}
+			c.publish(&Event{Type: eventRun, RunID: uuid.New().String(), Args: msg.Args, Tests: msg.Tests})
+		case "run-cancel":
+			c.publish(&Event{Type: eventRunCancel, RunID: msg.RunID})
 		default:
 			log.Println("Unknown message type:", msgType)
 		}
 	}
 }
 
+// publish sends an event from this client to everyone in its session.
+func (c *Client) publish(ev *Event) {
+	ev.SessionID = c.SessionID
+	ev.ConnID = c.ConnID
+	c.Hub.publish(ev)
+}
+
 // writePump pumps messages from the hub to the websocket connection.
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod)
@@ -159,19 +270,9 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.SendChan)
-			for i := 0; i < n; i++ {
-				w.Write(<-c.SendChan)
-			}
-
-			if err := w.Close(); err != nil {
+			// Every message goes in its own frame; clients parse each
+			// frame as a single JSON document.
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -0,0 +1,77 @@
+package ws
+
+import (
+	"errors"
+)
+
+// maxHistory bounds how many past operations a document keeps for
+// transforming late client operations. Clients further behind must resync.
+const maxHistory = 1000
+
+var ErrStaleVersion = errors.New("operation is based on a version that is no longer available")
+
+// Document is the authoritative text of one of a session's files. Every
+// accepted operation bumps its version; the recent history is kept so that
+// operations a client made against an older version can be transformed
+// before being applied.
+type Document struct {
+	text    string
+	version int
+
+	// history[i] took the document from version base+i to base+i+1.
+	history []*Operation
+	base    int
+}
+
+func NewDocument(text string) *Document {
+	return &Document{text: text}
+}
+
+// RestoreDocument recreates a document at a given version from a snapshot.
+// The history before that version is not available to it.
+func RestoreDocument(text string, version int) *Document {
+	return &Document{text: text, version: version, base: version}
+}
+
+// Text returns the current document text.
+func (d *Document) Text() string {
+	return d.text
+}
+
+// Version returns the number of operations applied so far.
+func (d *Document) Version() int {
+	return d.version
+}
+
+// Apply transforms op, which the client based on version, against every
+// operation applied since then, applies it and returns the transformed
+// operation that other clients must apply to catch up.
+func (d *Document) Apply(version int, op *Operation) (*Operation, error) {
+	if version < d.base || version > d.version {
+		return nil, ErrStaleVersion
+	}
+
+	var err error
+	for _, concurrent := range d.history[version-d.base:] {
+		op, _, err = Transform(op, concurrent)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	text, err := op.Apply(d.text)
+	if err != nil {
+		return nil, err
+	}
+
+	d.text = text
+	d.version++
+	d.history = append(d.history, op)
+	if len(d.history) > maxHistory {
+		drop := len(d.history) - maxHistory
+		d.history = append([]*Operation(nil), d.history[drop:]...)
+		d.base += drop
+	}
+
+	return op, nil
+}
@@ -0,0 +1,190 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"backend/internal/models"
+)
+
+// Event types exchanged over the backplane.
+const (
+	eventJoin     = "join"
+	eventLeave    = "leave"
+	eventEdit     = "edit"
+	eventLanguage = "language"
+	eventCursor   = "cursor"
+
+	// Changes to the session's file tree.
+	eventFileCreate = "file-create"
+	eventFileRename = "file-rename"
+	eventFileDelete = "file-delete"
+	eventEntrypoint = "entrypoint"
+
+	// A participant asked to run the session's code, which the instance
+	// the participant is connected to executes and streams to everyone.
+	eventRun       = "run"
+	eventRunOutput = "run-output"
+	eventRunExit   = "run-exit"
+	eventRunCancel = "run-cancel"
+	eventRunQueued = "run-queued"
+	// The instance executing a run says it is still going.
+	eventRunAlive = "run-alive"
+
+	// Someone ran code for the session outside of it, e.g. through
+	// POST /execute. Such runs end with a run-exit too.
+	eventRunStarted = "run-started"
+
+	// The owner changed a user's role in the session, or removed them.
+	eventMember = "member"
+
+	// The owner revoked an invite, disconnecting the guests who joined with
+	// it.
+	eventInviteRevoked = "invite-revoked"
+
+	// A hub opening a session asks the others for its current state.
+	eventSyncRequest = "sync-request"
+	eventState       = "state"
+
+	// FlushSession asks the instance saving the session to save it, which
+	// answers once it has.
+	eventFlushRequest = "flush-request"
+	eventFlushed      = "flushed"
+
+	// eventSyncTimeout is never published; a hub queues it for itself when
+	// nobody answered its sync-request in time.
+	eventSyncTimeout = "sync-timeout"
+)
+
+// Event is what hubs exchange over the backplane: every change to the shared
+// state of a session, in the order all instances apply it.
+type Event struct {
+	Type      string `json:"type"`
+	SessionID string `json:"sessionId"`
+
+	// The connection the event came from.
+	ConnID string `json:"connId,omitempty"`
+
+	// join: who joined.
+	Presence *Presence `json:"presence,omitempty"`
+
+	// edit: the file, the operation and the version of the file it is
+	// based on. An edit without a path is to the entrypoint.
+	Path      string     `json:"path,omitempty"`
+	Version   int        `json:"version,omitempty"`
+	Operation *Operation `json:"operation,omitempty"`
+
+	// file-create: the file's path and initial content. file-rename: its
+	// path and the new one. file-delete, entrypoint: its path.
+	NewPath string `json:"newPath,omitempty"`
+	Content string `json:"content,omitempty"`
+
+	// language: the new language.
+	Language string `json:"language,omitempty"`
+
+	// cursor: the new cursor position.
+	Cursor json.RawMessage `json:"cursor,omitempty"`
+
+	// run, run-output, run-exit, run-cancel, run-alive, run-started: the run.
+	// run-output carries a chunk of one of its streams, run-exit how it
+	// ended and run-started who ran what.
+	RunID  string                  `json:"runId,omitempty"`
+	Stream string                  `json:"stream,omitempty"`
+	Data   string                  `json:"data,omitempty"`
+	Exit   *models.ExecuteResponse `json:"exit,omitempty"`
+	Run    *RunInfo                `json:"run,omitempty"`
+
+	// run-queued: where the run is in line for a worker.
+	Position int `json:"position,omitempty"`
+
+	// run: the program's standard input and arguments, or the test cases
+	// to run it against. run-exit: the results of the test cases.
+	Stdin       string                       `json:"stdin,omitempty"`
+	Args        []string                     `json:"args,omitempty"`
+	Tests       []models.TestCase            `json:"tests,omitempty"`
+	TestResults *models.ExecuteTestsResponse `json:"testResults,omitempty"`
+
+	// member: the user and their new role, empty if they were removed.
+	UserID string `json:"userId,omitempty"`
+	Role   string `json:"role,omitempty"`
+
+	// invite-revoked: the invite.
+	InviteID string `json:"inviteId,omitempty"`
+
+	// sync-request, state, flush-request, flushed: the request being
+	// answered.
+	RequestID string `json:"requestId,omitempty"`
+
+	// state: the session as the answering hub had it at the sync-request.
+	State *SessionSnapshot `json:"state,omitempty"`
+}
+
+// Presence is one connection to a session, on whichever instance it lives.
+type Presence struct {
+	ConnID   string          `json:"connId"`
+	UserID   string          `json:"userId"`
+	Name     string          `json:"name"`
+	Color    string          `json:"color"`
+	Role     string          `json:"role"`
+	Cursor   json.RawMessage `json:"cursor,omitempty"`
+	CursorAt time.Time       `json:"cursorAt,omitempty"`
+
+	// Guest is set for someone without an account, who joined with the
+	// invite InviteID.
+	Guest    bool   `json:"guest,omitempty"`
+	InviteID string `json:"inviteId,omitempty"`
+
+	// Instance identifies the hub the connection is on.
+	Instance string `json:"instance,omitempty"`
+}
+
+// auditName is how the one connected is recorded in the session's history.
+func (p *Presence) auditName() string {
+	if p.Guest {
+		return "guest: " + p.Name
+	}
+	return p.Name
+}
+
+// SessionSnapshot is the shared state of a session handed to a hub that has
+// just opened it.
+type SessionSnapshot struct {
+	Files      []FileSnapshot `json:"files"`
+	Entrypoint string         `json:"entrypoint"`
+	Language   string         `json:"language"`
+	Presence   []*Presence    `json:"presence"`
+	Run        *ActiveRun     `json:"run,omitempty"`
+	// Saver is the connection whose instance saves the session.
+	Saver string `json:"saver,omitempty"`
+}
+
+// RunInfo describes a run to the session's participants.
+type RunInfo struct {
+	ID       string `json:"runId"`
+	UserID   string `json:"userId"`
+	UserName string `json:"userName"`
+	Language string `json:"language"`
+	CodeHash string `json:"codeHash"`
+}
+
+// owner is who the executor queues the run for: the user who started it, or
+// the session when that is unknown.
+func (info *RunInfo) owner(sessionID string) string {
+	if info.UserID != "" {
+		return info.UserID
+	}
+	return sessionID
+}
+
+// ActiveRun is the run in progress in a session. A session runs one program
+// at a time.
+type ActiveRun struct {
+	ID     string `json:"id"`
+	ConnID string `json:"connId"`
+
+	// cancel stops the run; it is only set on the instance executing it.
+	cancel context.CancelFunc
+	// expires is when the other instances give up on hearing from it.
+	expires time.Time
+}
@@ -1,15 +1,65 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"backend/internal/executor"
+	"backend/internal/models"
+
+	"github.com/google/uuid"
 )
 
-// Hub maintains the set of active clients and broadcasts messages to clients.
-type Hub struct {
-	// Registered clients.
-	Clients map[*Client]bool
+const (
+	// syncTimeout is how long a hub opening a session waits for another
+	// instance to send the session's state before assuming it is the only one.
+	syncTimeout = time.Second
+
+	// flushTimeout is how long FlushSession waits for an instance with the
+	// session open to save it. Nobody answers if no instance has it open.
+	flushTimeout = 250 * time.Millisecond
+
+	// runTimeout bounds a run started from the session once it has a
+	// worker, like the timeout of POST /execute.
+	runTimeout = 10 * time.Second
+)
+
+// SessionStore is the part of session.Store the hub needs to load files,
+// persist live edits and record runs.
+type SessionStore interface {
+	GetSession(id string) (*models.Session, bool)
+	SaveFile(id, path, content string)
+	DeleteFile(id, path string)
+	UpdateEntrypoint(id, path string)
+	UpdateLanguage(id, language string)
+	RecordRun(run *models.Run)
+}
 
-	// Inbound messages from the clients.
+// Runner executes the code of a session when a participant runs it.
+type Runner interface {
+	Execute(ctx context.Context, language string, req *executor.Request) (*executor.Result, error)
+}
+
+// Hub keeps track of the rooms of the sessions that have clients connected
+// to this instance and routes clients into them. Each room runs on its own
+// goroutine; the hub only decides when rooms open and close.
+//
+// Nothing is shared between goroutines without an owner: Run alone decides
+// room membership, and each room's goroutine alone touches its clients,
+// their send channels and the files. Client goroutines only ever talk to
+// the hub through Register and Unregister, and to their room through the
+// backplane.
+//
+// Everything that changes a session goes through the backplane as an Event,
+// even with a single instance, and is applied when it comes back. That way
+// every instance sharing the backplane applies the same events in the same
+// order and ends up with the same files.
+type Hub struct {
+	// Inbound messages for every client on this instance.
 	Broadcast chan []byte
 
 	// Register requests from the clients.
@@ -17,79 +67,252 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	Unregister chan *Client
+
+	// Open rooms by session ID, and how many clients each has. Only Run
+	// changes them; mu lets Rooms read them from other goroutines.
+	mu      sync.Mutex
+	rooms   map[string]*Room
+	members map[*Room]int
+
+	backplane Backplane
+	// id tells this instance apart from the others sharing the backplane.
+	id string
+	// A standalone hub is the only instance, so it never waits for a sync.
+	standalone bool
+
+	store   SessionStore
+	persist *persister
+
+	// Runner executes runs started by this instance's clients. Without
+	// one, runs are refused. It must be set before Run is called.
+	Runner Runner
+
+	// Languages, if set, are the languages a session may switch to; other
+	// changes are refused. Every instance must have the same set. It must
+	// be set before Run is called.
+	Languages []string
+}
+
+// NewHub returns a hub that is the only instance serving its sessions.
+func NewHub(store SessionStore) *Hub {
+	h := NewHubWithBackplane(store, NewMemoryBackplane())
+	h.standalone = true
+	return h
 }
 
-func NewHub() *Hub {
+// NewHubWithBackplane returns a hub that shares its sessions with the other
+// instances connected to the backplane.
+func NewHubWithBackplane(store SessionStore, backplane Backplane) *Hub {
 	return &Hub{
 		Broadcast:  make(chan []byte),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
-		Clients:    make(map[*Client]bool),
+		rooms:      make(map[string]*Room),
+		members:    make(map[*Room]int),
+		backplane:  backplane,
+		id:         uuid.New().String(),
+		store:      store,
+		persist:    newPersister(store),
 	}
 }
 
 func (h *Hub) Run() {
+	// Rooms that have been closed but may still be saving their session.
+	closing := make(map[string]*Room)
+
 	for {
 		select {
 		case client := <-h.Register:
-			h.Clients[client] = true
-			h.broadcastUserJoined(client)
+			h.mu.Lock()
+			room, ok := h.rooms[client.SessionID]
+			if !ok {
+				// A replacement room waits for the previous one to save
+				// the session before loading it.
+				previous := closing[client.SessionID]
+				delete(closing, client.SessionID)
+				room = newRoom(h, client.SessionID, previous)
+				h.rooms[client.SessionID] = room
+				go room.run()
+			}
+			h.members[room]++
+			h.mu.Unlock()
+
+			room.members <- membership{client: client, join: true}
 
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				close(client.SendChan)
-				h.broadcastUserLeft(client)
+			h.mu.Lock()
+			room, ok := h.rooms[client.SessionID]
+			last := false
+			if ok {
+				h.members[room]--
+				if h.members[room] == 0 {
+					last = true
+					delete(h.rooms, client.SessionID)
+					delete(h.members, room)
+				}
+			}
+			h.mu.Unlock()
+
+			if !ok {
+				continue
+			}
+			room.members <- membership{client: client}
+			if last {
+				// The room saves the session and shuts down.
+				close(room.members)
+				closing[client.SessionID] = room
 			}
 
 		case message := <-h.Broadcast:
-			for client := range h.Clients {
+			h.mu.Lock()
+			rooms := make([]*Room, 0, len(h.rooms))
+			for _, room := range h.rooms {
+				rooms = append(rooms, room)
+			}
+			h.mu.Unlock()
+
+			for _, room := range rooms {
 				select {
-				case client.SendChan <- message:
-				default:
-					close(client.SendChan)
-					delete(h.Clients, client)
+				case room.broadcasts <- message:
+				case <-room.done:
 				}
 			}
 		}
+
+		// Forget closed rooms once they are done.
+		for id, room := range closing {
+			select {
+			case <-room.done:
+				delete(closing, id)
+			default:
+			}
+		}
 	}
 }
 
-func (h *Hub) broadcastUserJoined(c *Client) {
-	msg := map[string]interface{}{
-		"type": "user-joined",
-		"data": map[string]interface{}{
-			"id":            c.UserID,
-			"name":          c.UserName,
-			"color":         c.UserColor,
-			"isCurrentUser": false, // Frontend will handle checking ID
-		},
+// Rooms reports the rooms currently open on this instance. It is safe to
+// call from any goroutine.
+func (h *Hub) Rooms() []RoomStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := make([]RoomStats, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		stats = append(stats, room.Stats())
 	}
-	bytes, _ := json.Marshal(msg)
-	h.BroadcastToOthers(bytes, c)
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].SessionID < stats[j].SessionID
+	})
+	return stats
 }
 
-func (h *Hub) broadcastUserLeft(c *Client) {
-	msg := map[string]interface{}{
-		"type": "user-left",
-		"data": map[string]interface{}{
-			"id": c.UserID,
-		},
+// publish sends an event to every instance following the session, this one
+// included. It is safe to call from any goroutine.
+func (h *Hub) publish(ev *Event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Could not encode %s event: %v", ev.Type, err)
+		return
 	}
-	bytes, _ := json.Marshal(msg)
-	h.BroadcastToOthers(bytes, c)
+	if err := h.backplane.Publish(context.Background(), ev.SessionID, payload); err != nil {
+		log.Printf("Could not publish %s event for session %s: %v", ev.Type, ev.SessionID, err)
+	}
+}
+
+// PublishRunStarted tells everyone in a session that someone ran code for it
+// outside the session's WebSocket, e.g. through POST /execute. It is safe to
+// call from any goroutine.
+func (h *Hub) PublishRunStarted(sessionID string, run *RunInfo) {
+	h.publish(&Event{Type: eventRunStarted, SessionID: sessionID, RunID: run.ID, Run: run})
+}
+
+// PublishRunQueued tells everyone in a session where a run announced with
+// PublishRunStarted is in line for a worker. It is safe to call from any
+// goroutine.
+func (h *Hub) PublishRunQueued(sessionID, runID string, position int) {
+	h.publish(&Event{Type: eventRunQueued, SessionID: sessionID, RunID: runID, Position: position})
+}
+
+// PublishRunExit tells everyone in a session how a run announced with
+// PublishRunStarted ended. It is safe to call from any goroutine.
+func (h *Hub) PublishRunExit(sessionID, runID string, exit *models.ExecuteResponse) {
+	h.publish(&Event{Type: eventRunExit, SessionID: sessionID, RunID: runID, Exit: exit})
+}
+
+// PublishMember tells a session that its owner gave a user a role, or removed
+// them from it if role is empty. It is safe to call from any goroutine.
+func (h *Hub) PublishMember(sessionID, userID, role string) {
+	h.publish(&Event{Type: eventMember, SessionID: sessionID, UserID: userID, Role: role})
+}
+
+// PublishInviteRevoked tells a session that an invite to it was revoked. It
+// is safe to call from any goroutine.
+func (h *Hub) PublishInviteRevoked(sessionID, inviteID string) {
+	h.publish(&Event{Type: eventInviteRevoked, SessionID: sessionID, InviteID: inviteID})
 }
 
-// BroadcastToOthers sends a message to all clients except the sender
-func (h *Hub) BroadcastToOthers(message []byte, sender *Client) {
-	for client := range h.Clients {
-		if client != sender && client.SessionID == sender.SessionID {
+// FlushSession writes any pending live changes of a session to the store, so
+// a read straight after an edit sees it. It is safe to call from any goroutine.
+//
+// With other instances, the changes are pending on whichever of them saves
+// the session, so the request goes through the backplane and that instance
+// answers once it has saved it. Without an answer in flushTimeout, it gives up: either
+// nobody has the session open and there is nothing to save, or the
+// instances are lagging and the read may miss the latest changes.
+func (h *Hub) FlushSession(sessionID string) {
+	if h.standalone {
+		h.persist.flush(sessionID)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	requestID := uuid.New().String()
+	flushed := make(chan struct{}, 1)
+	unsubscribe, err := h.backplane.Subscribe(ctx, sessionID, func(payload []byte) {
+		var ev Event
+		if json.Unmarshal(payload, &ev) == nil && ev.Type == eventFlushed && ev.RequestID == requestID {
 			select {
-			case client.SendChan <- message:
+			case flushed <- struct{}{}:
 			default:
-				close(client.SendChan)
-				delete(h.Clients, client)
 			}
 		}
+	})
+	if err != nil {
+		log.Printf("Could not flush session %s: %v", sessionID, err)
+		return
+	}
+	defer unsubscribe()
+
+	h.publish(&Event{Type: eventFlushRequest, SessionID: sessionID, RequestID: requestID})
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+	}
+}
+
+// supportsLanguage reports whether sessions may switch to language.
+func (h *Hub) supportsLanguage(language string) bool {
+	if language == "" {
+		return false
+	}
+	if h.Languages == nil {
+		return true
+	}
+	for _, supported := range h.Languages {
+		if supported == language {
+			return true
+		}
 	}
+	return false
+}
+
+// encodeMessage builds a {"type", "data"} message as sent to clients.
+func encodeMessage(msgType string, data interface{}) []byte {
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"type": msgType,
+		"data": data,
+	})
+	return bytes
 }
@@ -0,0 +1,527 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/models"
+	"backend/internal/session"
+
+	"github.com/google/uuid"
+)
+
+type testMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+func newTestClient(hub *Hub, sessionID, userID string) *Client {
+	return &Client{
+		Hub:       hub,
+		SendChan:  make(chan []byte, 256),
+		ConnID:    uuid.New().String(),
+		UserID:    userID,
+		UserName:  "User " + userID,
+		UserColor: "#000000",
+		SessionID: sessionID,
+		Role:      session.RoleOwner,
+	}
+}
+
+// nextMessage waits for the next message of the given type, skipping others.
+func nextMessage(t *testing.T, c *Client, msgType string) testMessage {
+	t.Helper()
+	return nextMessageWithin(t, c, msgType, time.Second)
+}
+
+func TestSessionStateOnJoin(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print(1)", Language: "python"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+
+	alice.publish(&Event{Type: eventCursor, Cursor: json.RawMessage(`{"line":1,"column":3}`)})
+
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- bob
+	state := decodeState(t, nextMessage(t, bob, "session-state"))
+
+	if state.Code != "print(1)" || state.Language != "python" || state.Version != 0 {
+		t.Errorf("Unexpected document in session-state: %+v", state)
+	}
+	if len(state.Participants) != 2 {
+		t.Fatalf("Expected 2 participants, got %d", len(state.Participants))
+	}
+	for _, p := range state.Participants {
+		if p.ID == "alice" && string(p.Cursor) != `{"line":1,"column":3}` {
+			t.Errorf("Expected alice's cursor, got %s", p.Cursor)
+		}
+		if p.IsCurrentUser != (p.ID == "bob") {
+			t.Errorf("Unexpected isCurrentUser for %s", p.ID)
+		}
+	}
+}
+
+func TestLanguageChange(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Language: "python"}
+
+	hub := NewHub(store)
+	hub.Languages = []string{"python", "go"}
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- alice
+	hub.Register <- bob
+	nextMessage(t, alice, "session-state")
+	nextMessage(t, bob, "session-state")
+
+	alice.publish(&Event{Type: eventLanguage, Language: "cobol"})
+	var rejected struct {
+		Type               string   `json:"type"`
+		SupportedLanguages []string `json:"supportedLanguages"`
+	}
+	if err := json.Unmarshal(nextMessage(t, alice, "error").Data, &rejected); err != nil {
+		t.Fatalf("Invalid error: %v", err)
+	}
+	if rejected.Type != "language-change" || len(rejected.SupportedLanguages) != 2 {
+		t.Errorf("Unexpected error %+v", rejected)
+	}
+
+	bob.publish(&Event{Type: eventLanguage, Language: "go"})
+	nextMessage(t, alice, "language-change")
+
+	// Only the valid change was applied.
+	carol := newTestClient(hub, "s1", "carol")
+	hub.Register <- carol
+	if state := decodeState(t, nextMessage(t, carol, "session-state")); state.Language != "go" {
+		t.Errorf("Language = %q, want go", state.Language)
+	}
+}
+
+func TestFileTree(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "import utils", Language: "python", Entrypoint: "main.py"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- alice
+	hub.Register <- bob
+	nextMessage(t, alice, "session-state")
+	nextMessage(t, bob, "session-state")
+
+	alice.publish(&Event{Type: eventFileCreate, Path: "utils.py", Content: "x = 1"})
+	nextMessage(t, bob, "file-create")
+
+	// Edits are addressed by path; those without one go to the entrypoint.
+	bob.publish(&Event{Type: eventEdit, Path: "utils.py", Version: 0, Operation: NewOperation().Retain(5).Insert("0")})
+	var update struct {
+		Path    string `json:"path"`
+		Version int    `json:"version"`
+	}
+	json.Unmarshal(nextMessage(t, alice, "code-update").Data, &update)
+	if update.Path != "utils.py" || update.Version != 1 {
+		t.Errorf("Unexpected code-update %+v", update)
+	}
+	bob.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(12).Insert("\n")})
+	json.Unmarshal(nextMessage(t, alice, "code-update").Data, &update)
+	if update.Path != "main.py" {
+		t.Errorf("Expected an edit without a path to go to main.py, got %q", update.Path)
+	}
+
+	// Changes that can't be made are refused.
+	for _, ev := range []*Event{
+		{Type: eventFileCreate, Path: "utils.py"},
+		{Type: eventFileCreate, Path: "../escape.py"},
+		{Type: eventFileDelete, Path: "main.py"},
+		{Type: eventFileRename, Path: "missing.py", NewPath: "other.py"},
+		{Type: eventEdit, Path: "missing.py", Operation: NewOperation().Insert("x")},
+	} {
+		alice.publish(ev)
+		var refused struct {
+			Type string `json:"type"`
+			Path string `json:"path"`
+		}
+		json.Unmarshal(nextMessage(t, alice, "error").Data, &refused)
+		if refused.Path != ev.Path {
+			t.Errorf("Expected %s of %s to be refused, got %+v", ev.Type, ev.Path, refused)
+		}
+	}
+
+	alice.publish(&Event{Type: eventFileRename, Path: "main.py", NewPath: "app.py"})
+	nextMessage(t, bob, "file-rename")
+	alice.publish(&Event{Type: eventFileCreate, Path: "lib/scratch.py"})
+	alice.publish(&Event{Type: eventFileDelete, Path: "lib/scratch.py"})
+	nextMessage(t, bob, "file-delete")
+
+	carol := newTestClient(hub, "s1", "carol")
+	hub.Register <- carol
+	state := decodeState(t, nextMessage(t, carol, "session-state"))
+	if state.Entrypoint != "app.py" || state.Code != "import utils\n" || len(state.Files) != 2 {
+		t.Fatalf("Unexpected session-state %+v", state)
+	}
+	if f := state.Files[1]; f.Path != "utils.py" || f.Content != "x = 10" || f.Version != 1 {
+		t.Errorf("Unexpected utils.py %+v", f)
+	}
+
+	bob.publish(&Event{Type: eventEntrypoint, Path: "utils.py"})
+	nextMessage(t, alice, "entrypoint-change")
+
+	// The last one out saves the files.
+	for _, c := range []*Client{alice, bob, carol} {
+		hub.Unregister <- c
+	}
+	waitFor(t, func() bool { return len(hub.Rooms()) == 0 })
+	waitFor(t, func() bool {
+		s, _ := store.GetSession("s1")
+		return s.Entrypoint == "utils.py" && s.Code == "x = 10" && len(s.Files) == 2
+	})
+}
+
+func TestRoles(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print(1)", Language: "python"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	bob := newTestClient(hub, "s1", "bob")
+	bob.Role = session.RoleObserver
+	hub.Register <- alice
+	hub.Register <- bob
+	nextMessage(t, alice, "session-state")
+	state := decodeState(t, nextMessage(t, bob, "session-state"))
+	for _, p := range state.Participants {
+		if p.ID == "bob" && p.Role != session.RoleObserver {
+			t.Errorf("Expected bob to be shown as an observer, got %q", p.Role)
+		}
+	}
+
+	// An observer can follow along but not change anything.
+	bob.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(8).Insert("!")})
+	var refused struct {
+		Type  string `json:"type"`
+		Error string `json:"error"`
+	}
+	json.Unmarshal(nextMessage(t, bob, "error").Data, &refused)
+	if refused.Type != "code-update" || refused.Error != ErrNotAllowed.Error() {
+		t.Errorf("Expected the edit to be refused, got %+v", refused)
+	}
+	bob.publish(&Event{Type: eventRun, RunID: "r1"})
+	nextMessage(t, bob, "run-rejected")
+
+	hub.PublishMember("s1", "bob", session.RoleCandidate)
+	nextMessage(t, alice, "role-change")
+	bob.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Retain(8).Insert("!")})
+	nextMessage(t, alice, "code-update")
+
+	// A candidate can't change the language.
+	bob.publish(&Event{Type: eventLanguage, Language: "javascript"})
+	json.Unmarshal(nextMessage(t, bob, "error").Data, &refused)
+	if refused.Type != "language-change" {
+		t.Errorf("Expected the language change to be refused, got %+v", refused)
+	}
+
+	// A user removed from the session is disconnected.
+	hub.PublishMember("s1", "bob", "")
+	waitFor(t, func() bool {
+		select {
+		case _, ok := <-bob.SendChan:
+			return !ok
+		default:
+			return false
+		}
+	})
+}
+
+func TestGuests(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print(1)", Language: "python"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	ada := newTestClient(hub, "s1", "guest:1")
+	ada.UserName, ada.Guest, ada.InviteID = "Ada", true, "invite1"
+	ada.Role = session.RoleCandidate
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+	hub.Register <- ada
+	nextMessage(t, ada, "session-state")
+
+	var joined struct {
+		Name  string `json:"name"`
+		Guest bool   `json:"guest"`
+	}
+	json.Unmarshal(nextMessage(t, alice, "user-joined").Data, &joined)
+	if joined.Name != "Ada" || !joined.Guest {
+		t.Errorf("Expected Ada to be shown as a guest, got %+v", joined)
+	}
+
+	// A guest's runs are recorded as theirs.
+	ada.publish(&Event{Type: eventRun, RunID: "r1"})
+	var started RunInfo
+	json.Unmarshal(nextMessage(t, alice, "run-started").Data, &started)
+	if started.UserName != "guest: Ada" {
+		t.Errorf("Expected the run to be recorded as guest: Ada, got %q", started.UserName)
+	}
+
+	// Revoking the invite disconnects its guests.
+	hub.PublishInviteRevoked("s1", "invite1")
+	waitFor(t, func() bool {
+		select {
+		case _, ok := <-ada.SendChan:
+			return !ok
+		default:
+			return false
+		}
+	})
+}
+
+func TestSameUserIsOneParticipant(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- bob
+	nextMessage(t, bob, "session-state")
+
+	tab1 := newTestClient(hub, "s1", "alice")
+	tab2 := newTestClient(hub, "s1", "alice")
+	hub.Register <- tab1
+	hub.Register <- tab2
+
+	carol := newTestClient(hub, "s1", "carol")
+	hub.Register <- carol
+	state := decodeState(t, nextMessage(t, carol, "session-state"))
+	if len(state.Participants) != 3 {
+		t.Fatalf("Expected 3 participants, got %d", len(state.Participants))
+	}
+	for _, p := range state.Participants {
+		if p.ID == "alice" && p.Connections != 2 {
+			t.Errorf("Expected alice to have 2 connections, got %d", p.Connections)
+		}
+	}
+
+	// Closing one tab doesn't mean alice left.
+	hub.Unregister <- tab1
+	dave := newTestClient(hub, "s1", "dave")
+	hub.Register <- dave
+	nextMessage(t, dave, "session-state")
+
+	joined, left := 0, 0
+	for len(bob.SendChan) > 0 {
+		var msg testMessage
+		json.Unmarshal(<-bob.SendChan, &msg)
+		var data struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(msg.Data, &data)
+		if data.ID != "alice" {
+			continue
+		}
+		switch msg.Type {
+		case "user-joined":
+			joined++
+		case "user-left":
+			left++
+		}
+	}
+	if joined != 1 || left != 0 {
+		t.Errorf("Expected alice to join once and not leave, got %d joins and %d leaves", joined, left)
+	}
+}
+
+type stateMessage struct {
+	Code         string         `json:"code"`
+	Version      int            `json:"version"`
+	Language     string         `json:"language"`
+	Entrypoint   string         `json:"entrypoint"`
+	Files        []FileSnapshot `json:"files"`
+	Participants []Participant  `json:"participants"`
+}
+
+func decodeState(t *testing.T, msg testMessage) stateMessage {
+	t.Helper()
+	var state stateMessage
+	if err := json.Unmarshal(msg.Data, &state); err != nil {
+		t.Fatalf("Invalid session-state: %v", err)
+	}
+	return state
+}
+
+func TestRoomLifecycle(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1"}
+	store.sessions["s2"] = &models.Session{ID: "s2"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	bob := newTestClient(hub, "s1", "bob")
+	carol := newTestClient(hub, "s2", "carol")
+	for _, c := range []*Client{alice, bob, carol} {
+		hub.Register <- c
+		nextMessage(t, c, "session-state")
+	}
+
+	waitFor(t, func() bool {
+		rooms := hub.Rooms()
+		return len(rooms) == 2 && rooms[0].SessionID == "s1" &&
+			rooms[0].Clients == 2 && rooms[0].Participants == 2
+	})
+
+	// Messages in one room never reach the other.
+	alice.publish(&Event{Type: eventEdit, Operation: NewOperation().Insert("x")})
+	nextMessage(t, bob, "code-update")
+	if len(carol.SendChan) != 0 {
+		t.Errorf("Expected nothing for carol, got %d messages", len(carol.SendChan))
+	}
+
+	hub.Unregister <- alice
+	hub.Unregister <- bob
+	waitFor(t, func() bool { return len(hub.Rooms()) == 1 })
+
+	// The last one out saves the session.
+	waitFor(t, func() bool {
+		s, _ := store.GetSession("s1")
+		return s.Code == "x"
+	})
+
+	// Joining again opens a fresh room with the saved code.
+	dave := newTestClient(hub, "s1", "dave")
+	hub.Register <- dave
+	if state := decodeState(t, nextMessage(t, dave, "session-state")); state.Code != "x" {
+		t.Errorf("Expected saved code in new room, got %q", state.Code)
+	}
+}
+
+func TestLastEditsSavedWhenRoomCloses(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+
+	// The client leaves while its edits are still on their way to the room.
+	for i := 0; i < 20; i++ {
+		alice.publish(&Event{Type: eventEdit, Version: i, Operation: NewOperation().Retain(i).Insert("x")})
+	}
+	hub.Unregister <- alice
+
+	want := strings.Repeat("x", 20)
+	waitFor(t, func() bool {
+		s, _ := store.GetSession("s1")
+		return s.Code == want
+	})
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Run with -race: clients join, edit, get broadcasts and leave across a few
+// sessions all at once.
+func TestHubConcurrentJoinLeaveBroadcast(t *testing.T) {
+	store := newFakeStore()
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("s%d", i)
+		store.sessions[id] = &models.Session{ID: id}
+	}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < 40; i++ {
+				c := newTestClient(hub, fmt.Sprintf("s%d", rng.Intn(4)), fmt.Sprintf("user%d", w))
+				drained := make(chan struct{})
+				go func() {
+					for range c.SendChan {
+					}
+					close(drained)
+				}()
+
+				hub.Register <- c
+				for j := 0; j < 3; j++ {
+					c.publish(&Event{Type: eventCursor, Cursor: json.RawMessage(`{"line":1}`)})
+					c.publish(&Event{Type: eventEdit, Version: 0, Operation: NewOperation().Insert("x")})
+				}
+				if i%10 == 0 {
+					hub.Broadcast <- encodeMessage("notice", "hello")
+				}
+				hub.Unregister <- c
+
+				// The room closes the send channel exactly once.
+				<-drained
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	waitFor(t, func() bool { return len(hub.Rooms()) == 0 })
+}
+
+func TestSlowClientIsDropped(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	fast := newTestClient(hub, "s1", "fast")
+	hub.Register <- fast
+	nextMessage(t, fast, "session-state")
+
+	// A client that never reads fills its buffer and gets dropped.
+	slow := newTestClient(hub, "s1", "slow")
+	slow.SendChan = make(chan []byte, 1)
+	hub.Register <- slow
+	// Once fast sees it join, its session-state fills its buffer.
+	nextMessage(t, fast, "user-joined")
+	for i := 0; i < 5; i++ {
+		fast.publish(&Event{Type: eventCursor, Cursor: json.RawMessage(`{"line":1}`)})
+	}
+	nextMessage(t, fast, "user-left")
+
+	// Its connection going away afterwards must not close the channel again.
+	hub.Unregister <- slow
+	hub.Unregister <- fast
+	waitFor(t, func() bool { return len(hub.Rooms()) == 0 })
+}
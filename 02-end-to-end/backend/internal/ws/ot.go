@@ -0,0 +1,274 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+)
+
+// Operation is an edit spanning a whole document, in the format used by ot.js:
+// a sequence of components that retain, insert or delete text. On the wire it
+// is a JSON array where a positive integer retains that many characters, a
+// negative integer deletes them and a string is inserted.
+//
+// Lengths are counted in UTF-16 code units so that positions agree with the
+// JavaScript strings the editor works with.
+type Operation struct {
+	Ops []Op
+
+	// BaseLength is the length of the document the operation applies to.
+	BaseLength int
+	// TargetLength is the length of the document after applying it.
+	TargetLength int
+}
+
+// Op is a single component of an Operation. Exactly one field is set.
+type Op struct {
+	Retain int
+	Insert string
+	Delete int
+}
+
+func (o Op) isRetain() bool { return o.Retain > 0 }
+func (o Op) isInsert() bool { return o.Insert != "" }
+func (o Op) isDelete() bool { return o.Delete > 0 }
+
+var (
+	ErrBaseLength     = errors.New("operation base length does not match document")
+	ErrIncompatibleOp = errors.New("operations are not based on the same document")
+)
+
+// NewOperation returns an empty operation.
+func NewOperation() *Operation {
+	return &Operation{}
+}
+
+// Retain skips over n characters.
+func (op *Operation) Retain(n int) *Operation {
+	if n <= 0 {
+		return op
+	}
+	op.BaseLength += n
+	op.TargetLength += n
+	if last := len(op.Ops) - 1; last >= 0 && op.Ops[last].isRetain() {
+		op.Ops[last].Retain += n
+		return op
+	}
+	op.Ops = append(op.Ops, Op{Retain: n})
+	return op
+}
+
+// Insert inserts s at the current position.
+func (op *Operation) Insert(s string) *Operation {
+	if s == "" {
+		return op
+	}
+	op.TargetLength += textLength(s)
+	last := len(op.Ops) - 1
+	switch {
+	case last >= 0 && op.Ops[last].isInsert():
+		op.Ops[last].Insert += s
+	case last >= 0 && op.Ops[last].isDelete():
+		// Keep inserts before deletes so equivalent operations compare equal.
+		if last > 0 && op.Ops[last-1].isInsert() {
+			op.Ops[last-1].Insert += s
+		} else {
+			op.Ops = append(op.Ops, op.Ops[last])
+			op.Ops[last] = Op{Insert: s}
+		}
+	default:
+		op.Ops = append(op.Ops, Op{Insert: s})
+	}
+	return op
+}
+
+// Delete removes n characters at the current position.
+func (op *Operation) Delete(n int) *Operation {
+	if n <= 0 {
+		return op
+	}
+	op.BaseLength += n
+	if last := len(op.Ops) - 1; last >= 0 && op.Ops[last].isDelete() {
+		op.Ops[last].Delete += n
+		return op
+	}
+	op.Ops = append(op.Ops, Op{Delete: n})
+	return op
+}
+
+// IsNoop reports whether applying the operation leaves the document unchanged.
+func (op *Operation) IsNoop() bool {
+	return len(op.Ops) == 0 || (len(op.Ops) == 1 && op.Ops[0].isRetain())
+}
+
+// Apply applies the operation to doc and returns the resulting text.
+func (op *Operation) Apply(doc string) (string, error) {
+	src := utf16.Encode([]rune(doc))
+	if len(src) != op.BaseLength {
+		return "", ErrBaseLength
+	}
+
+	out := make([]uint16, 0, op.TargetLength)
+	pos := 0
+	for _, o := range op.Ops {
+		switch {
+		case o.isRetain():
+			out = append(out, src[pos:pos+o.Retain]...)
+			pos += o.Retain
+		case o.isInsert():
+			out = append(out, utf16.Encode([]rune(o.Insert))...)
+		case o.isDelete():
+			pos += o.Delete
+		}
+	}
+	return string(utf16.Decode(out)), nil
+}
+
+// Transform takes two operations a and b that were made concurrently on the
+// same document and returns a' and b' such that applying a then b' yields the
+// same document as applying b then a'. When both insert at the same position,
+// a's insert is placed first.
+func Transform(a, b *Operation) (*Operation, *Operation, error) {
+	if a.BaseLength != b.BaseLength {
+		return nil, nil, ErrIncompatibleOp
+	}
+
+	aPrime, bPrime := NewOperation(), NewOperation()
+	ops1, ops2 := a.Ops, b.Ops
+	i1, i2 := 0, 0
+	var op1, op2 Op
+	next1 := func() {
+		if i1 < len(ops1) {
+			op1 = ops1[i1]
+			i1++
+		} else {
+			op1 = Op{}
+		}
+	}
+	next2 := func() {
+		if i2 < len(ops2) {
+			op2 = ops2[i2]
+			i2++
+		} else {
+			op2 = Op{}
+		}
+	}
+	next1()
+	next2()
+
+	for {
+		empty1, empty2 := op1 == Op{}, op2 == Op{}
+		if empty1 && empty2 {
+			break
+		}
+
+		if op1.isInsert() {
+			aPrime.Insert(op1.Insert)
+			bPrime.Retain(textLength(op1.Insert))
+			next1()
+			continue
+		}
+		if op2.isInsert() {
+			aPrime.Retain(textLength(op2.Insert))
+			bPrime.Insert(op2.Insert)
+			next2()
+			continue
+		}
+		if empty1 || empty2 {
+			return nil, nil, ErrIncompatibleOp
+		}
+
+		switch {
+		case op1.isRetain() && op2.isRetain():
+			n := min(op1.Retain, op2.Retain)
+			aPrime.Retain(n)
+			bPrime.Retain(n)
+			op1.Retain -= n
+			op2.Retain -= n
+		case op1.isDelete() && op2.isDelete():
+			// Both sides deleted the same text; nothing left to do for it.
+			n := min(op1.Delete, op2.Delete)
+			op1.Delete -= n
+			op2.Delete -= n
+		case op1.isDelete() && op2.isRetain():
+			n := min(op1.Delete, op2.Retain)
+			aPrime.Delete(n)
+			op1.Delete -= n
+			op2.Retain -= n
+		case op1.isRetain() && op2.isDelete():
+			n := min(op1.Retain, op2.Delete)
+			bPrime.Delete(n)
+			op1.Retain -= n
+			op2.Delete -= n
+		}
+
+		if op1 == (Op{}) {
+			next1()
+		}
+		if op2 == (Op{}) {
+			next2()
+		}
+	}
+
+	return aPrime, bPrime, nil
+}
+
+// MarshalJSON encodes the operation in the ot.js array format.
+func (op *Operation) MarshalJSON() ([]byte, error) {
+	parts := make([]interface{}, 0, len(op.Ops))
+	for _, o := range op.Ops {
+		switch {
+		case o.isRetain():
+			parts = append(parts, o.Retain)
+		case o.isInsert():
+			parts = append(parts, o.Insert)
+		case o.isDelete():
+			parts = append(parts, -o.Delete)
+		}
+	}
+	return json.Marshal(parts)
+}
+
+// UnmarshalJSON decodes an operation from the ot.js array format.
+func (op *Operation) UnmarshalJSON(data []byte) error {
+	var parts []json.RawMessage
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return err
+	}
+
+	*op = Operation{}
+	for _, part := range parts {
+		var s string
+		if err := json.Unmarshal(part, &s); err == nil {
+			if s == "" {
+				return errors.New("operation contains an empty insert")
+			}
+			op.Insert(s)
+			continue
+		}
+
+		var n int
+		if err := json.Unmarshal(part, &n); err != nil {
+			return fmt.Errorf("invalid operation component %s", part)
+		}
+		switch {
+		case n > 0:
+			op.Retain(n)
+		case n < 0:
+			op.Delete(-n)
+		default:
+			return errors.New("operation contains a zero-length component")
+		}
+	}
+	return nil
+}
+
+// textLength returns the length of s in UTF-16 code units.
+func textLength(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16.RuneLen(r)
+	}
+	return n
+}
@@ -0,0 +1,166 @@
+package ws
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+func TestOperationApply(t *testing.T) {
+	op := NewOperation().Retain(6).Delete(5).Insert("Gophers")
+
+	got, err := op.Apply("Hello World")
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if got != "Hello Gophers" {
+		t.Errorf("Expected %q, got %q", "Hello Gophers", got)
+	}
+
+	if _, err := op.Apply("too short"); err != ErrBaseLength {
+		t.Errorf("Expected ErrBaseLength, got %v", err)
+	}
+}
+
+func TestOperationUTF16Lengths(t *testing.T) {
+	// "😀" is two UTF-16 code units, as the editor counts it.
+	op := NewOperation().Retain(2).Insert("é")
+
+	got, err := op.Apply("😀")
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if got != "😀é" {
+		t.Errorf("Expected %q, got %q", "😀é", got)
+	}
+}
+
+func TestOperationJSON(t *testing.T) {
+	var op Operation
+	if err := json.Unmarshal([]byte(`[3, "abc", -2, 1]`), &op); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if op.BaseLength != 6 || op.TargetLength != 7 {
+		t.Errorf("Unexpected lengths %d -> %d", op.BaseLength, op.TargetLength)
+	}
+
+	data, err := json.Marshal(&op)
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(data) != `[3,"abc",-2,1]` {
+		t.Errorf("Unexpected encoding %s", data)
+	}
+
+	if err := json.Unmarshal([]byte(`[0]`), &op); err == nil {
+		t.Errorf("Expected error for zero-length component")
+	}
+}
+
+func TestTransformConcurrentInserts(t *testing.T) {
+	doc := "abc"
+	a := NewOperation().Retain(1).Insert("X").Retain(2)
+	b := NewOperation().Retain(1).Insert("Y").Retain(2)
+
+	aPrime, bPrime, err := Transform(a, b)
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	left := mustApply(t, mustApply(t, doc, a), bPrime)
+	right := mustApply(t, mustApply(t, doc, b), aPrime)
+	if left != right {
+		t.Fatalf("Documents diverged: %q vs %q", left, right)
+	}
+	if left != "aXYbc" {
+		t.Errorf("Expected a's insert first, got %q", left)
+	}
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		doc := randomText(rng, rng.Intn(20))
+		a := randomOperation(rng, doc)
+		b := randomOperation(rng, doc)
+
+		aPrime, bPrime, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("Transform failed: %v", err)
+		}
+
+		left := mustApply(t, mustApply(t, doc, a), bPrime)
+		right := mustApply(t, mustApply(t, doc, b), aPrime)
+		if left != right {
+			t.Fatalf("Documents diverged for %q: %q vs %q", doc, left, right)
+		}
+	}
+}
+
+func TestDocumentTransformsStaleOperations(t *testing.T) {
+	doc := NewDocument("hello")
+
+	// Two clients both edit version 0.
+	if _, err := doc.Apply(0, NewOperation().Insert("> ").Retain(5)); err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	op, err := doc.Apply(0, NewOperation().Retain(5).Insert("!"))
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+
+	if doc.Text() != "> hello!" {
+		t.Errorf("Expected %q, got %q", "> hello!", doc.Text())
+	}
+	if doc.Version() != 2 {
+		t.Errorf("Expected version 2, got %d", doc.Version())
+	}
+	if op.BaseLength != 7 {
+		t.Errorf("Expected transformed op based on length 7, got %d", op.BaseLength)
+	}
+
+	if _, err := doc.Apply(5, NewOperation().Retain(8)); err != ErrStaleVersion {
+		t.Errorf("Expected ErrStaleVersion, got %v", err)
+	}
+}
+
+func mustApply(t *testing.T, doc string, op *Operation) string {
+	t.Helper()
+	out, err := op.Apply(doc)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	return out
+}
+
+func randomText(rng *rand.Rand, n int) string {
+	const alphabet = "abcdef é😀\n"
+	runes := []rune(alphabet)
+	out := make([]rune, n)
+	for i := range out {
+		out[i] = runes[rng.Intn(len(runes))]
+	}
+	return string(out)
+}
+
+// randomOperation builds an operation over doc, stepping over whole runes so
+// surrogate pairs are never split.
+func randomOperation(rng *rand.Rand, doc string) *Operation {
+	op := NewOperation()
+	for _, r := range doc {
+		n := textLength(string(r))
+		switch rng.Intn(4) {
+		case 0:
+			op.Delete(n)
+		case 1:
+			op.Insert(randomText(rng, 1+rng.Intn(3)))
+			op.Retain(n)
+		default:
+			op.Retain(n)
+		}
+	}
+	if rng.Intn(2) == 0 {
+		op.Insert(randomText(rng, 1+rng.Intn(3)))
+	}
+	return op
+}
@@ -0,0 +1,161 @@
+package ws
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// persistDelay is how long a session has to be idle before its pending
+	// changes are written, so a burst of keystrokes becomes a single write.
+	persistDelay = 2 * time.Second
+
+	// maxPersistDelay bounds how long changes stay unsaved while a session
+	// is being edited continuously.
+	maxPersistDelay = 10 * time.Second
+)
+
+// pendingWrite holds the changes of one session not yet written to the store.
+type pendingWrite struct {
+	// files maps the paths of changed files to their content, or to nil if
+	// they were deleted.
+	files      map[string]*string
+	entrypoint *string
+	language   *string
+	since      time.Time
+	timer      *time.Timer
+}
+
+// persister debounces writes of live session state back to the store.
+type persister struct {
+	store    SessionStore
+	delay    time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+	// flushing holds the lock of each session being written, so a flush
+	// returns only once any write of the same session already in progress
+	// has reached the store, without waiting on other sessions.
+	flushing map[string]*flushLock
+}
+
+// flushLock is held while writing a session, by as many flushes as refs.
+type flushLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newPersister(store SessionStore) *persister {
+	return &persister{
+		store:    store,
+		delay:    persistDelay,
+		maxDelay: maxPersistDelay,
+		pending:  make(map[string]*pendingWrite),
+		flushing: make(map[string]*flushLock),
+	}
+}
+
+// scheduleFile records the latest content of a file to be written later.
+func (p *persister) scheduleFile(sessionID, path, content string) {
+	p.schedule(sessionID, func(w *pendingWrite) { w.files[path] = &content })
+}
+
+// scheduleDelete records that a file is gone, to be deleted later.
+func (p *persister) scheduleDelete(sessionID, path string) {
+	p.schedule(sessionID, func(w *pendingWrite) { w.files[path] = nil })
+}
+
+// scheduleEntrypoint records the latest entrypoint of a session to be
+// written later.
+func (p *persister) scheduleEntrypoint(sessionID, path string) {
+	p.schedule(sessionID, func(w *pendingWrite) { w.entrypoint = &path })
+}
+
+// scheduleLanguage records the latest language of a session to be written later.
+func (p *persister) scheduleLanguage(sessionID, language string) {
+	p.schedule(sessionID, func(w *pendingWrite) { w.language = &language })
+}
+
+func (p *persister) schedule(sessionID string, update func(*pendingWrite)) {
+	if p.store == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	w, ok := p.pending[sessionID]
+	if !ok {
+		w = &pendingWrite{files: make(map[string]*string), since: time.Now()}
+		w.timer = time.AfterFunc(p.delay, func() { p.flush(sessionID) })
+		p.pending[sessionID] = w
+	} else {
+		// Push the write back, but not past maxDelay since the first change.
+		wait := p.delay
+		if remaining := p.maxDelay - time.Since(w.since); remaining < wait {
+			wait = max(remaining, 0)
+		}
+		w.timer.Reset(wait)
+	}
+	update(w)
+}
+
+// flush writes the pending changes of a session immediately.
+func (p *persister) flush(sessionID string) {
+	p.lock(sessionID)
+	defer p.unlock(sessionID)
+
+	p.mu.Lock()
+	w, ok := p.pending[sessionID]
+	if ok {
+		w.timer.Stop()
+		delete(p.pending, sessionID)
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	// The entrypoint's file has to exist before it becomes the entrypoint.
+	for path, content := range w.files {
+		if content == nil {
+			p.store.DeleteFile(sessionID, path)
+		} else {
+			p.store.SaveFile(sessionID, path, *content)
+		}
+	}
+	if w.entrypoint != nil {
+		p.store.UpdateEntrypoint(sessionID, *w.entrypoint)
+	}
+	if w.language != nil {
+		p.store.UpdateLanguage(sessionID, *w.language)
+	}
+}
+
+// lock waits for any write of a session in progress and holds its lock.
+func (p *persister) lock(sessionID string) {
+	p.mu.Lock()
+	l, ok := p.flushing[sessionID]
+	if !ok {
+		l = &flushLock{}
+		p.flushing[sessionID] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+
+	l.Lock()
+}
+
+// unlock releases the lock of a session, dropping it once no flush holds or
+// waits for it.
+func (p *persister) unlock(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.flushing[sessionID]
+	l.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(p.flushing, sessionID)
+	}
+}
@@ -0,0 +1,211 @@
+package ws
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"backend/internal/models"
+)
+
+type fakeStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*models.Session
+	codeWrite int
+	runs      []*models.Run
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{sessions: make(map[string]*models.Session)}
+}
+
+// GetSession gives a session without files its code as the entrypoint, like
+// session.Store.
+func (f *fakeStore) GetSession(id string) (*models.Session, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if s.Entrypoint == "" {
+		s.Entrypoint = "main"
+	}
+	if len(s.Files) == 0 {
+		s.Files = []models.SessionFile{{SessionID: id, Path: s.Entrypoint, Content: s.Code}}
+	}
+	copied := *s
+	copied.Files = append([]models.SessionFile(nil), s.Files...)
+	return &copied, true
+}
+
+func (f *fakeStore) SaveFile(id, path, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.codeWrite++
+	s, ok := f.sessions[id]
+	if !ok {
+		return
+	}
+	if path == s.Entrypoint {
+		s.Code = content
+	}
+	for i := range s.Files {
+		if s.Files[i].Path == path {
+			s.Files[i].Content = content
+			return
+		}
+	}
+	s.Files = append(s.Files, models.SessionFile{SessionID: id, Path: path, Content: content})
+}
+
+func (f *fakeStore) DeleteFile(id, path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		s.Files = slices.DeleteFunc(s.Files, func(file models.SessionFile) bool { return file.Path == path })
+	}
+}
+
+func (f *fakeStore) UpdateEntrypoint(id, path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.sessions[id]
+	if !ok {
+		return
+	}
+	s.Entrypoint = path
+	for _, file := range s.Files {
+		if file.Path == path {
+			s.Code = file.Content
+		}
+	}
+}
+
+func (f *fakeStore) UpdateLanguage(id, language string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok := f.sessions[id]; ok {
+		s.Language = language
+	}
+}
+
+func (f *fakeStore) RecordRun(run *models.Run) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.runs = append(f.runs, run)
+}
+
+func (f *fakeStore) recordedRuns() []*models.Run {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*models.Run(nil), f.runs...)
+}
+
+func (f *fakeStore) writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.codeWrite
+}
+
+func TestPersisterDebouncesWrites(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "", Language: "python", Entrypoint: "main.py"}
+
+	p := newPersister(store)
+	p.delay = 20 * time.Millisecond
+
+	for _, code := range []string{"a", "ab", "abc"} {
+		p.scheduleFile("s1", "main.py", code)
+	}
+	p.scheduleLanguage("s1", "go")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if n := store.writes(); n != 1 {
+		t.Errorf("Expected 1 write, got %d", n)
+	}
+	s, _ := store.GetSession("s1")
+	if s.Code != "abc" || s.Language != "go" {
+		t.Errorf("Unexpected stored session: %+v", s)
+	}
+}
+
+func TestPersisterFlush(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Entrypoint: "main.py"}
+
+	p := newPersister(store)
+	p.scheduleFile("s1", "main.py", "print(1)")
+	p.flush("s1")
+
+	s, _ := store.GetSession("s1")
+	if s.Code != "print(1)" {
+		t.Errorf("Expected code to be flushed, got %q", s.Code)
+	}
+
+	// Nothing pending any more.
+	p.flush("s1")
+	if n := store.writes(); n != 1 {
+		t.Errorf("Expected 1 write, got %d", n)
+	}
+}
+
+// blockingStore holds the writes of one session until release is closed.
+type blockingStore struct {
+	*fakeStore
+	blocked string
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) SaveFile(id, path, content string) {
+	if id == b.blocked {
+		close(b.started)
+		<-b.release
+	}
+	b.fakeStore.SaveFile(id, path, content)
+}
+
+func TestPersisterFlushDoesNotWaitForOtherSessions(t *testing.T) {
+	store := &blockingStore{
+		fakeStore: newFakeStore(),
+		blocked:   "s1",
+		started:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	store.sessions["s1"] = &models.Session{ID: "s1", Entrypoint: "main.py"}
+	store.sessions["s2"] = &models.Session{ID: "s2", Entrypoint: "main.py"}
+
+	p := newPersister(store)
+	p.scheduleFile("s1", "main.py", "slow")
+	p.scheduleFile("s2", "main.py", "fast")
+
+	slow := make(chan struct{})
+	go func() {
+		p.flush("s1")
+		close(slow)
+	}()
+	<-store.started
+
+	fast := make(chan struct{})
+	go func() {
+		p.flush("s2")
+		close(fast)
+	}()
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		t.Fatal("Expected a flush not to wait for another session's write")
+	}
+
+	close(store.release)
+	<-slow
+	if s, _ := store.GetSession("s1"); s.Code != "slow" {
+		t.Errorf("Expected the slow write to complete, got %q", s.Code)
+	}
+	if len(p.flushing) != 0 {
+		t.Errorf("Expected no session locks left, got %d", len(p.flushing))
+	}
+}
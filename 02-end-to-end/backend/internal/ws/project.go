@@ -0,0 +1,205 @@
+package ws
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"backend/internal/executor"
+	"backend/internal/models"
+)
+
+// defaultEntrypoint names the only file of a session the store doesn't know.
+const defaultEntrypoint = "main"
+
+var (
+	ErrFileExists       = errors.New("file already exists")
+	ErrNoSuchFile       = errors.New("no such file")
+	ErrDeleteEntrypoint = errors.New("the entrypoint can't be deleted")
+)
+
+// Project is the file tree of a session: a document per file, the file that
+// is run and the language they are written in. There is always at least the
+// entrypoint.
+type Project struct {
+	files      map[string]*Document
+	entrypoint string
+	language   string
+}
+
+// NewProject returns a project with a single empty file, the entrypoint.
+func NewProject(language, entrypoint string) *Project {
+	return &Project{
+		files:      map[string]*Document{entrypoint: NewDocument("")},
+		entrypoint: entrypoint,
+		language:   language,
+	}
+}
+
+// LoadProject returns the project of a stored session.
+func LoadProject(session *models.Session) *Project {
+	entrypoint := session.Entrypoint
+	if entrypoint == "" {
+		entrypoint = defaultEntrypoint
+	}
+	p := &Project{
+		files:      make(map[string]*Document, len(session.Files)),
+		entrypoint: entrypoint,
+		language:   session.Language,
+	}
+	for _, f := range session.Files {
+		p.files[f.Path] = NewDocument(f.Content)
+	}
+	if _, ok := p.files[entrypoint]; !ok {
+		p.files[entrypoint] = NewDocument(session.Code)
+	}
+	return p
+}
+
+// FileSnapshot is a file of a session as of a version.
+type FileSnapshot struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+	Version int    `json:"version"`
+}
+
+// RestoreProject recreates a project from a snapshot of its files.
+func RestoreProject(language, entrypoint string, files []FileSnapshot) *Project {
+	p := &Project{
+		files:      make(map[string]*Document, len(files)),
+		entrypoint: entrypoint,
+		language:   language,
+	}
+	for _, f := range files {
+		p.files[f.Path] = RestoreDocument(f.Content, f.Version)
+	}
+	if _, ok := p.files[entrypoint]; !ok {
+		p.files[entrypoint] = NewDocument("")
+	}
+	return p
+}
+
+// Snapshot returns the files ordered by path.
+func (p *Project) Snapshot() []FileSnapshot {
+	files := make([]FileSnapshot, 0, len(p.files))
+	for _, path := range p.Paths() {
+		doc := p.files[path]
+		files = append(files, FileSnapshot{Path: path, Content: doc.Text(), Version: doc.Version()})
+	}
+	return files
+}
+
+// Paths returns the paths of the files in order.
+func (p *Project) Paths() []string {
+	paths := make([]string, 0, len(p.files))
+	for path := range p.files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// File returns the document of a file. An empty path stands for the
+// entrypoint, for clients that only know about one file.
+func (p *Project) File(path string) (*Document, bool) {
+	if path == "" {
+		path = p.entrypoint
+	}
+	doc, ok := p.files[path]
+	return doc, ok
+}
+
+// Entrypoint returns the path of the file that is run.
+func (p *Project) Entrypoint() string {
+	return p.entrypoint
+}
+
+// Language returns the language the session is written in.
+func (p *Project) Language() string {
+	return p.language
+}
+
+// SetLanguage changes the language the session is written in.
+func (p *Project) SetLanguage(language string) {
+	p.language = language
+}
+
+// Version returns the number of operations applied to the files.
+func (p *Project) Version() int {
+	version := 0
+	for _, doc := range p.files {
+		version += doc.Version()
+	}
+	return version
+}
+
+// Create adds a file.
+func (p *Project) Create(path, content string) error {
+	if err := executor.ValidatePath(path); err != nil {
+		return err
+	}
+	if _, ok := p.files[path]; ok {
+		return ErrFileExists
+	}
+	if len(p.files) >= executor.MaxFiles {
+		return fmt.Errorf("a session can have at most %d files", executor.MaxFiles)
+	}
+	p.files[path] = NewDocument(content)
+	return nil
+}
+
+// Rename moves a file to a new path, keeping its history. The entrypoint
+// stays the entrypoint.
+func (p *Project) Rename(from, to string) error {
+	doc, ok := p.files[from]
+	if !ok {
+		return ErrNoSuchFile
+	}
+	if err := executor.ValidatePath(to); err != nil {
+		return err
+	}
+	if _, ok := p.files[to]; ok {
+		return ErrFileExists
+	}
+	delete(p.files, from)
+	p.files[to] = doc
+	if p.entrypoint == from {
+		p.entrypoint = to
+	}
+	return nil
+}
+
+// Delete removes a file other than the entrypoint.
+func (p *Project) Delete(path string) error {
+	if _, ok := p.files[path]; !ok {
+		return ErrNoSuchFile
+	}
+	if path == p.entrypoint {
+		return ErrDeleteEntrypoint
+	}
+	delete(p.files, path)
+	return nil
+}
+
+// SetEntrypoint makes a file the one that is run.
+func (p *Project) SetEntrypoint(path string) error {
+	if _, ok := p.files[path]; !ok {
+		return ErrNoSuchFile
+	}
+	p.entrypoint = path
+	return nil
+}
+
+// Sources returns what a run needs: the code of the entrypoint and the other
+// files by path.
+func (p *Project) Sources() (code string, files map[string]string) {
+	files = make(map[string]string, len(p.files)-1)
+	for path, doc := range p.files {
+		if path == p.entrypoint {
+			code = doc.Text()
+		} else {
+			files[path] = doc.Text()
+		}
+	}
+	return code, files
+}
@@ -0,0 +1,835 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"backend/internal/session"
+
+	"github.com/google/uuid"
+)
+
+// roomQueueSize is how many membership changes or events can wait for a room.
+const roomQueueSize = 256
+
+// ErrNotAllowed refuses a change the role of the one asking doesn't allow.
+var ErrNotAllowed = errors.New("your role in the session doesn't allow this")
+
+// membership is a client joining or leaving a room, as decided by the hub.
+type membership struct {
+	client *Client
+	join   bool
+}
+
+// RoomStats describes a room for monitoring.
+type RoomStats struct {
+	SessionID    string    `json:"sessionId"`
+	Clients      int       `json:"clients"`
+	Participants int       `json:"participants"`
+	Version      int       `json:"version"`
+	OpenedAt     time.Time `json:"openedAt"`
+}
+
+// Room is a session as seen by one hub: its local clients, the shared
+// files and everyone's presence. A room runs on its own goroutine, which
+// owns all of that state, so broadcasting costs only as much as the room is
+// big and busy sessions don't hold each other up.
+type Room struct {
+	ID  string
+	hub *Hub
+
+	// Local clients, and the same clients by ConnID.
+	clients map[*Client]bool
+	conns   map[string]*Client
+
+	project *Project
+
+	// Every connection to the session, local or on another instance.
+	presence map[string]*Presence
+
+	// The run in progress, if any.
+	activeRun *ActiveRun
+
+	// The session is saved by a single instance, the one saver is connected
+	// to, so an edit is written once however many instances apply it. saves
+	// is set while that is this one.
+	saver string
+	saves bool
+
+	// Until synced, the room is waiting for the session state from another
+	// instance. Events following its own sync-request are held in pending
+	// and applied on top of that state once it arrives.
+	synced    bool
+	requestID string
+	requested bool
+	pending   []*Event
+
+	// Membership changes from the hub, in the order it made them. The hub
+	// closes the channel once the last client has left.
+	members chan membership
+	// Session events delivered by the backplane.
+	events chan *Event
+	// Messages for every local client.
+	broadcasts chan []byte
+
+	// previous is the room this one replaces, which must have saved the
+	// session before this one loads it.
+	previous *Room
+	// done is closed once the room has shut down.
+	done chan struct{}
+
+	statsMu sync.Mutex
+	stats   RoomStats
+}
+
+func newRoom(hub *Hub, sessionID string, previous *Room) *Room {
+	return &Room{
+		ID:         sessionID,
+		hub:        hub,
+		clients:    make(map[*Client]bool),
+		conns:      make(map[string]*Client),
+		presence:   make(map[string]*Presence),
+		members:    make(chan membership, roomQueueSize),
+		events:     make(chan *Event, roomQueueSize),
+		broadcasts: make(chan []byte, roomQueueSize),
+		previous:   previous,
+		done:       make(chan struct{}),
+		stats:      RoomStats{SessionID: sessionID, OpenedAt: time.Now()},
+	}
+}
+
+// Stats returns the room's current size. It is safe to call from any goroutine.
+func (r *Room) Stats() RoomStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+func (r *Room) run() {
+	defer close(r.done)
+
+	if r.previous != nil {
+		<-r.previous.done
+	}
+
+	unsubscribe, err := r.open()
+	if err != nil {
+		log.Printf("Could not open room %s: %v", r.ID, err)
+		// Turn everyone away until the hub closes the room.
+		for m := range r.members {
+			if m.join {
+				close(m.client.SendChan)
+			}
+		}
+		return
+	}
+	log.Printf("Room %s opened", r.ID)
+
+	for {
+		select {
+		case m, ok := <-r.members:
+			if !ok {
+				r.close(unsubscribe)
+				log.Printf("Room %s closed", r.ID)
+				return
+			}
+			if m.join {
+				r.register(m.client)
+			} else if r.clients[m.client] {
+				r.drop(m.client)
+			}
+
+		case ev := <-r.events:
+			r.handleEvent(ev)
+
+		case message := <-r.broadcasts:
+			for client := range r.clients {
+				r.send(client, message)
+			}
+		}
+		r.updateStats()
+	}
+}
+
+// open subscribes to the session's events and gets hold of its state,
+// either from another instance or from the store.
+func (r *Room) open() (func(), error) {
+	unsubscribe, err := r.hub.backplane.Subscribe(context.Background(), r.ID, func(payload []byte) {
+		var ev Event
+		if err := json.Unmarshal(payload, &ev); err != nil {
+			log.Println("Invalid backplane event:", err)
+			return
+		}
+		r.deliver(&ev)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if r.hub.standalone {
+		r.load()
+		r.synced = true
+		r.saves = true
+		return unsubscribe, nil
+	}
+
+	r.requestID = uuid.New().String()
+	r.hub.publish(&Event{Type: eventSyncRequest, SessionID: r.ID, RequestID: r.requestID})
+	time.AfterFunc(syncTimeout, func() {
+		r.deliver(&Event{Type: eventSyncTimeout, RequestID: r.requestID})
+	})
+	return unsubscribe, nil
+}
+
+// close stops following the session and saves it. The events of the last
+// clients may still be on their way to the room, so they are applied first;
+// once unsubscribed, nothing more can arrive but what is already queued.
+func (r *Room) close(unsubscribe func()) {
+	unsubscribed := make(chan struct{})
+	go func() {
+		unsubscribe()
+		close(unsubscribed)
+	}()
+
+	for drained := false; !drained; {
+		select {
+		case ev := <-r.events:
+			r.handleEvent(ev)
+		case <-unsubscribed:
+			for len(r.events) > 0 {
+				r.handleEvent(<-r.events)
+			}
+			drained = true
+		}
+	}
+	r.hub.persist.flush(r.ID)
+}
+
+// deliver queues an event for the room unless it has shut down.
+func (r *Room) deliver(ev *Event) {
+	select {
+	case r.events <- ev:
+	case <-r.done:
+	}
+}
+
+// load initialises the files from the store.
+func (r *Room) load() {
+	r.project = NewProject("", defaultEntrypoint)
+	if store := r.hub.store; store != nil {
+		if session, ok := store.GetSession(r.ID); ok {
+			r.project = LoadProject(session)
+		}
+	}
+}
+
+func (r *Room) updateStats() {
+	users := make(map[string]bool)
+	for _, p := range r.presence {
+		users[p.UserID] = true
+	}
+
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	r.stats.Clients = len(r.clients)
+	r.stats.Participants = len(users)
+	if r.project != nil {
+		r.stats.Version = r.project.Version()
+	}
+}
+
+func (r *Room) register(c *Client) {
+	r.clients[c] = true
+	r.conns[c.ConnID] = c
+
+	// The client gets its session-state once its join comes back from the
+	// backplane, so the snapshot lines up with the events that follow it.
+	r.hub.publish(&Event{
+		Type:      eventJoin,
+		SessionID: r.ID,
+		ConnID:    c.ConnID,
+		Presence: &Presence{
+			ConnID:   c.ConnID,
+			UserID:   c.UserID,
+			Name:     c.UserName,
+			Color:    c.UserColor,
+			Role:     c.Role,
+			Guest:    c.Guest,
+			InviteID: c.InviteID,
+			Instance: r.hub.id,
+		},
+	})
+}
+
+// drop disconnects a local client and tells the session it left.
+func (r *Room) drop(c *Client) {
+	delete(r.clients, c)
+	delete(r.conns, c.ConnID)
+	close(c.SendChan)
+
+	r.hub.publish(&Event{Type: eventLeave, SessionID: r.ID, ConnID: c.ConnID})
+}
+
+// hasUser reports whether a user has any connection open to the session.
+func (r *Room) hasUser(userID string) bool {
+	for _, p := range r.presence {
+		if p.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// localClient returns the client for a connection if it is on this instance.
+func (r *Room) localClient(connID string) *Client {
+	c, ok := r.conns[connID]
+	if !ok || !r.clients[c] {
+		return nil
+	}
+	return c
+}
+
+func (r *Room) handleEvent(ev *Event) {
+	if !r.synced {
+		r.handleUnsynced(ev)
+		return
+	}
+
+	switch ev.Type {
+	case eventSyncRequest:
+		r.answerSync(ev)
+	case eventFlushRequest:
+		r.answerFlush(ev)
+	case eventJoin:
+		r.join(ev)
+	case eventLeave:
+		r.leave(ev)
+	case eventEdit:
+		r.applyEdit(ev)
+	case eventLanguage:
+		r.changeLanguage(ev)
+	case eventFileCreate:
+		r.createFile(ev)
+	case eventFileRename:
+		r.renameFile(ev)
+	case eventFileDelete:
+		r.deleteFile(ev)
+	case eventEntrypoint:
+		r.changeEntrypoint(ev)
+	case eventCursor:
+		r.moveCursor(ev)
+	case eventRun:
+		r.startRun(ev)
+	case eventRunQueued:
+		r.relayRunQueued(ev)
+	case eventRunAlive:
+		r.extendRun(ev)
+	case eventRunOutput:
+		r.relayRunOutput(ev)
+	case eventRunExit:
+		r.endRun(ev)
+	case eventRunCancel:
+		r.cancelRun(ev)
+	case eventRunStarted:
+		r.announceRun(ev.Run)
+	case eventMember:
+		r.changeRole(ev)
+	case eventInviteRevoked:
+		r.revokeInvite(ev)
+	}
+}
+
+// handleUnsynced deals with events that arrive while the room waits for the
+// state of the session from another instance.
+func (r *Room) handleUnsynced(ev *Event) {
+	switch {
+	case ev.Type == eventSyncRequest && ev.RequestID == r.requestID:
+		// Our own request: the state we get answers it as of here, so
+		// everything from now on has to be applied on top of it.
+		r.requested = true
+
+	case ev.Type == eventState && ev.RequestID == r.requestID && ev.State != nil:
+		r.project = RestoreProject(ev.State.Language, ev.State.Entrypoint, ev.State.Files)
+		for _, p := range ev.State.Presence {
+			r.presence[p.ConnID] = p
+		}
+		r.activeRun = ev.State.Run
+		if r.activeRun != nil {
+			r.activeRun.expires = time.Now().Add(runLease)
+		}
+		r.saver = ev.State.Saver
+		r.finishSync()
+
+	case ev.Type == eventSyncTimeout && ev.RequestID == r.requestID:
+		// Nobody else has the session open.
+		r.load()
+		r.finishSync()
+
+	case r.requested && ev.Type != eventState && ev.Type != eventSyncTimeout:
+		r.pending = append(r.pending, ev)
+	}
+}
+
+func (r *Room) finishSync() {
+	r.synced = true
+	r.updateSaver()
+	pending := r.pending
+	r.pending = nil
+	for _, ev := range pending {
+		r.handleEvent(ev)
+	}
+}
+
+// answerSync sends another instance the state of a session it just opened.
+func (r *Room) answerSync(ev *Event) {
+	snapshot := &SessionSnapshot{
+		Files:      r.project.Snapshot(),
+		Entrypoint: r.project.Entrypoint(),
+		Language:   r.project.Language(),
+		Presence:   make([]*Presence, 0, len(r.presence)),
+		Saver:      r.saver,
+	}
+	for _, p := range r.presence {
+		snapshot.Presence = append(snapshot.Presence, p)
+	}
+	if r.activeRun != nil {
+		snapshot.Run = &ActiveRun{ID: r.activeRun.ID, ConnID: r.activeRun.ConnID}
+	}
+	r.hub.publish(&Event{Type: eventState, SessionID: r.ID, RequestID: ev.RequestID, State: snapshot})
+}
+
+// answerFlush saves the session for whoever asked, if this instance is the
+// one saving it. Every change published before the request has been
+// applied, so the store is up to date with it.
+func (r *Room) answerFlush(ev *Event) {
+	if !r.saves {
+		return
+	}
+	r.hub.persist.flush(r.ID)
+	r.hub.publish(&Event{Type: eventFlushed, SessionID: r.ID, RequestID: ev.RequestID})
+}
+
+func (r *Room) join(ev *Event) {
+	p := ev.Presence
+	if p == nil {
+		return
+	}
+	firstConn := !r.hasUser(p.UserID)
+	r.presence[p.ConnID] = p
+	r.updateSaver()
+
+	if c := r.localClient(p.ConnID); c != nil {
+		r.sendSessionState(c)
+	}
+	if firstConn {
+		r.broadcast(encodeMessage("user-joined", map[string]interface{}{
+			"id":            p.UserID,
+			"name":          p.Name,
+			"color":         p.Color,
+			"guest":         p.Guest,
+			"isCurrentUser": false, // Frontend will handle checking ID
+		}), p.ConnID)
+	}
+}
+
+func (r *Room) leave(ev *Event) {
+	p, ok := r.presence[ev.ConnID]
+	if !ok {
+		return
+	}
+	delete(r.presence, ev.ConnID)
+	r.updateSaver()
+	r.abandonRun(ev.ConnID)
+
+	// Closing one of several tabs doesn't mean the user left.
+	if !r.hasUser(p.UserID) {
+		r.broadcast(encodeMessage("user-left", map[string]interface{}{
+			"id": p.UserID,
+		}), ev.ConnID)
+	}
+}
+
+// updateSaver works out which instance saves the session once its presence
+// has changed. Every instance applies the same joins and leaves, so they all
+// agree: the saver stays until it leaves, and is then replaced by the
+// connection with the lowest ID. Connections from instances that don't say
+// which one they are on leave every instance saving, as before.
+func (r *Room) updateSaver() {
+	if r.hub.standalone {
+		return
+	}
+	previous := r.saver
+	if _, ok := r.presence[r.saver]; !ok {
+		r.saver = ""
+		for connID := range r.presence {
+			if r.saver == "" || connID < r.saver {
+				r.saver = connID
+			}
+		}
+	}
+
+	saves := false
+	if p, ok := r.presence[r.saver]; ok {
+		saves = p.Instance == r.hub.id || p.Instance == ""
+	}
+	switch {
+	case saves && !r.saves && previous != "":
+		// The instance saving the session until now may not have written
+		// everything before it left.
+		r.saveAll()
+	case !saves && r.saves:
+		// Hand over with nothing left to write here.
+		r.hub.persist.flush(r.ID)
+	}
+	r.saves = saves
+}
+
+// saveFile, saveDelete, saveEntrypoint and saveLanguage schedule a change to
+// be written if this instance saves the session.
+func (r *Room) saveFile(path, content string) {
+	if r.saves {
+		r.hub.persist.scheduleFile(r.ID, path, content)
+	}
+}
+
+func (r *Room) saveDelete(path string) {
+	if r.saves {
+		r.hub.persist.scheduleDelete(r.ID, path)
+	}
+}
+
+func (r *Room) saveEntrypoint(path string) {
+	if r.saves {
+		r.hub.persist.scheduleEntrypoint(r.ID, path)
+	}
+}
+
+func (r *Room) saveLanguage(language string) {
+	if r.saves {
+		r.hub.persist.scheduleLanguage(r.ID, language)
+	}
+}
+
+// saveAll schedules every file, the entrypoint and the language to be written.
+func (r *Room) saveAll() {
+	for _, file := range r.project.Snapshot() {
+		r.hub.persist.scheduleFile(r.ID, file.Path, file.Content)
+	}
+	r.hub.persist.scheduleEntrypoint(r.ID, r.project.Entrypoint())
+	r.hub.persist.scheduleLanguage(r.ID, r.project.Language())
+}
+
+// applyEdit applies a client's operation to one of the session's files,
+// acknowledges it to the sender and broadcasts the transformed operation to
+// everyone else.
+func (r *Room) applyEdit(ev *Event) {
+	if ev.Operation == nil || !r.allowed(ev, session.ActionEdit, "code-update") {
+		return
+	}
+	origin := r.localClient(ev.ConnID)
+
+	path := ev.Path
+	if path == "" {
+		path = r.project.Entrypoint()
+	}
+	doc, ok := r.project.File(path)
+	if !ok {
+		r.refuse(ev, "code-update", ErrNoSuchFile)
+		return
+	}
+
+	op, err := doc.Apply(ev.Version, ev.Operation)
+	if err != nil {
+		if origin != nil {
+			log.Printf("Rejected edit from %s in session %s: %v", origin.UserID, r.ID, err)
+			// The client is out of step with the server; hand it the
+			// current file so it can start over from there.
+			r.send(origin, encodeMessage("code-resync", map[string]interface{}{
+				"path":    path,
+				"code":    doc.Text(),
+				"version": doc.Version(),
+				"error":   err.Error(),
+			}))
+		}
+		return
+	}
+
+	r.saveFile(path, doc.Text())
+
+	if origin != nil {
+		r.send(origin, encodeMessage("code-ack", map[string]interface{}{
+			"path":    path,
+			"version": doc.Version(),
+		}))
+	}
+	r.broadcast(encodeMessage("code-update", map[string]interface{}{
+		"path":      path,
+		"version":   doc.Version(),
+		"operation": op,
+		"userId":    r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// changeLanguage switches the language of the session and tells everyone else.
+// Languages that can't be run are refused, and the one who asked is told.
+func (r *Room) changeLanguage(ev *Event) {
+	if !r.allowed(ev, session.ActionConfigure, "language-change") {
+		return
+	}
+	if !r.hub.supportsLanguage(ev.Language) {
+		if origin := r.localClient(ev.ConnID); origin != nil {
+			r.send(origin, encodeMessage("error", map[string]interface{}{
+				"type":               "language-change",
+				"error":              fmt.Sprintf("unsupported language: %q", ev.Language),
+				"supportedLanguages": r.hub.Languages,
+			}))
+		}
+		return
+	}
+
+	r.project.SetLanguage(ev.Language)
+	r.saveLanguage(ev.Language)
+
+	r.broadcast(encodeMessage("language-change", map[string]interface{}{
+		"language": ev.Language,
+		"userId":   r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// createFile adds a file to the session and tells everyone else. Changes to
+// the files that can't be made are refused, and the one who asked is told.
+func (r *Room) createFile(ev *Event) {
+	if !r.allowed(ev, session.ActionEdit, "file-create") {
+		return
+	}
+	if err := r.project.Create(ev.Path, ev.Content); err != nil {
+		r.refuse(ev, "file-create", err)
+		return
+	}
+	r.saveFile(ev.Path, ev.Content)
+
+	r.broadcast(encodeMessage("file-create", map[string]interface{}{
+		"path":    ev.Path,
+		"content": ev.Content,
+		"userId":  r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// renameFile moves a file to a new path and tells everyone else.
+func (r *Room) renameFile(ev *Event) {
+	if !r.allowed(ev, session.ActionEdit, "file-rename") {
+		return
+	}
+	if err := r.project.Rename(ev.Path, ev.NewPath); err != nil {
+		r.refuse(ev, "file-rename", err)
+		return
+	}
+	doc, _ := r.project.File(ev.NewPath)
+	r.saveFile(ev.NewPath, doc.Text())
+	r.saveDelete(ev.Path)
+	if r.project.Entrypoint() == ev.NewPath {
+		r.saveEntrypoint(ev.NewPath)
+	}
+
+	r.broadcast(encodeMessage("file-rename", map[string]interface{}{
+		"path":    ev.Path,
+		"newPath": ev.NewPath,
+		"userId":  r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// deleteFile removes a file and tells everyone else.
+func (r *Room) deleteFile(ev *Event) {
+	if !r.allowed(ev, session.ActionEdit, "file-delete") {
+		return
+	}
+	if err := r.project.Delete(ev.Path); err != nil {
+		r.refuse(ev, "file-delete", err)
+		return
+	}
+	r.saveDelete(ev.Path)
+
+	r.broadcast(encodeMessage("file-delete", map[string]interface{}{
+		"path":   ev.Path,
+		"userId": r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// changeEntrypoint makes another file the one that is run and tells
+// everyone else.
+func (r *Room) changeEntrypoint(ev *Event) {
+	if !r.allowed(ev, session.ActionEdit, "entrypoint-change") {
+		return
+	}
+	if err := r.project.SetEntrypoint(ev.Path); err != nil {
+		r.refuse(ev, "entrypoint-change", err)
+		return
+	}
+	r.saveEntrypoint(ev.Path)
+
+	r.broadcast(encodeMessage("entrypoint-change", map[string]interface{}{
+		"path":   ev.Path,
+		"userId": r.userOf(ev.ConnID),
+	}), ev.ConnID)
+}
+
+// changeRole applies the owner's change to a user's role. A user removed from
+// the session is disconnected.
+func (r *Room) changeRole(ev *Event) {
+	for connID, p := range r.presence {
+		if p.UserID != ev.UserID {
+			continue
+		}
+		p.Role = ev.Role
+		if c := r.localClient(connID); c != nil && ev.Role == "" {
+			r.drop(c)
+		}
+	}
+
+	r.broadcast(encodeMessage("role-change", map[string]interface{}{
+		"userId": ev.UserID,
+		"role":   ev.Role,
+	}), "")
+}
+
+// revokeInvite disconnects the guests who joined with a revoked invite.
+func (r *Room) revokeInvite(ev *Event) {
+	for connID, p := range r.presence {
+		if p.InviteID != ev.InviteID {
+			continue
+		}
+		if c := r.localClient(connID); c != nil {
+			r.drop(c)
+		}
+	}
+}
+
+// allowed reports whether the role of the one who sent ev allows action. If
+// not, they are told they can't send msgType.
+func (r *Room) allowed(ev *Event, action, msgType string) bool {
+	if p, ok := r.presence[ev.ConnID]; ok && session.Can(p.Role, action) {
+		return true
+	}
+	r.refuse(ev, msgType, ErrNotAllowed)
+	return false
+}
+
+// refuse tells the one who sent ev, if connected here, why the change it
+// asked for was not made.
+func (r *Room) refuse(ev *Event, msgType string, err error) {
+	origin := r.localClient(ev.ConnID)
+	if origin == nil {
+		return
+	}
+	r.send(origin, encodeMessage("error", map[string]interface{}{
+		"type":  msgType,
+		"path":  ev.Path,
+		"error": err.Error(),
+	}))
+}
+
+func (r *Room) moveCursor(ev *Event) {
+	p, ok := r.presence[ev.ConnID]
+	if !ok {
+		return
+	}
+	p.Cursor = ev.Cursor
+	p.CursorAt = time.Now()
+
+	r.broadcast(encodeMessage("cursor-move", map[string]interface{}{
+		"userId":       p.UserID,
+		"connectionId": p.ConnID,
+		"cursor":       ev.Cursor,
+	}), ev.ConnID)
+}
+
+func (r *Room) userOf(connID string) string {
+	if p, ok := r.presence[connID]; ok {
+		return p.UserID
+	}
+	return ""
+}
+
+// Participant describes a connected user in a session-state snapshot. A user
+// connected from several tabs is one participant with several connections.
+type Participant struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	Color         string          `json:"color"`
+	Role          string          `json:"role"`
+	Guest         bool            `json:"guest,omitempty"`
+	Cursor        json.RawMessage `json:"cursor,omitempty"`
+	Connections   int             `json:"connections"`
+	IsCurrentUser bool            `json:"isCurrentUser"`
+}
+
+// sendSessionState sends a newly joined client everything it needs to catch
+// up: the files, their versions and language, and who else is in the room.
+// The entrypoint is also sent as code, for clients that only know about one
+// file.
+func (r *Room) sendSessionState(c *Client) {
+	participants := []*Participant{}
+	byUser := make(map[string]*Participant)
+	cursorAt := make(map[string]time.Time)
+	for _, presence := range r.presence {
+		p, ok := byUser[presence.UserID]
+		if !ok {
+			p = &Participant{
+				ID:            presence.UserID,
+				Name:          presence.Name,
+				Color:         presence.Color,
+				Role:          presence.Role,
+				Guest:         presence.Guest,
+				IsCurrentUser: presence.UserID == c.UserID,
+			}
+			byUser[presence.UserID] = p
+			participants = append(participants, p)
+		}
+		p.Connections++
+
+		// Show the cursor of whichever tab the user moved most recently.
+		if presence.Cursor != nil && presence.CursorAt.After(cursorAt[presence.UserID]) {
+			p.Cursor = presence.Cursor
+			cursorAt[presence.UserID] = presence.CursorAt
+		}
+	}
+	sort.Slice(participants, func(i, j int) bool {
+		return participants[i].Name < participants[j].Name
+	})
+
+	entrypoint, _ := r.project.File("")
+	r.send(c, encodeMessage("session-state", map[string]interface{}{
+		"code":         entrypoint.Text(),
+		"version":      entrypoint.Version(),
+		"language":     r.project.Language(),
+		"entrypoint":   r.project.Entrypoint(),
+		"files":        r.project.Snapshot(),
+		"participants": participants,
+	}))
+}
+
+// send queues a message for a single client, dropping the client if it
+// cannot keep up.
+func (r *Room) send(client *Client, message []byte) {
+	select {
+	case client.SendChan <- message:
+	default:
+		r.drop(client)
+	}
+}
+
+// broadcast sends a message to the room's local clients, except the
+// connection it came from.
+func (r *Room) broadcast(message []byte, exceptConnID string) {
+	for client := range r.clients {
+		if client.ConnID != exceptConnID {
+			r.send(client, message)
+		}
+	}
+}
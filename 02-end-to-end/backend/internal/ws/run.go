@@ -0,0 +1,423 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"backend/internal/executor"
+	"backend/internal/models"
+	"backend/internal/session"
+)
+
+// errRunsUnavailable ends runs on an instance that has no Runner.
+var errRunsUnavailable = errors.New("code execution is not available")
+
+const (
+	// runFlushInterval is how long output may wait before it is published,
+	// so that a chatty program doesn't turn into an event per line.
+	runFlushInterval = 50 * time.Millisecond
+
+	// runHeartbeat is how often the instance executing a run tells the
+	// others it is still going, whether it is running or waiting for a
+	// worker.
+	runHeartbeat = 5 * time.Second
+
+	// runLease is how long the other instances wait to hear about a run
+	// before giving up on it, e.g. because its instance went away.
+	runLease = runTimeout + runHeartbeat
+)
+
+// Output streams of a run.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// startRun handles a participant's request to run the session's files. Every
+// instance sees the same requests in the same order, so they all agree on
+// which run is in progress; the instance of the participant who asked
+// executes it.
+func (r *Room) startRun(ev *Event) {
+	origin := r.localClient(ev.ConnID)
+
+	var rejected string
+	switch p, ok := r.presence[ev.ConnID]; {
+	case !ok || !session.Can(p.Role, session.ActionRun):
+		rejected = ErrNotAllowed.Error()
+	case r.running():
+		rejected = "another run is in progress"
+	}
+	if rejected != "" {
+		if origin != nil {
+			r.send(origin, encodeMessage("run-rejected", map[string]interface{}{
+				"runId": ev.RunID,
+				"error": rejected,
+			}))
+		}
+		return
+	}
+	r.activeRun = &ActiveRun{ID: ev.RunID, ConnID: ev.ConnID, expires: time.Now().Add(runLease)}
+
+	code, files := r.project.Sources()
+	entrypoint := r.project.Entrypoint()
+	info := &RunInfo{
+		ID:       ev.RunID,
+		Language: r.project.Language(),
+		CodeHash: executor.CodeHash(code, files),
+	}
+	if p, ok := r.presence[ev.ConnID]; ok {
+		info.UserID, info.UserName = p.UserID, p.auditName()
+	}
+	r.announceRun(info)
+
+	if origin == nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.activeRun.cancel = cancel
+	go keepRunAlive(ctx, r.hub, r.ID, ev.RunID)
+	if len(ev.Tests) > 0 {
+		go executeTests(ctx, cancel, r.hub, r.ID, info, &models.ExecuteTestsRequest{
+			Code:       code,
+			Language:   info.Language,
+			Entrypoint: entrypoint,
+			Files:      files,
+			Args:       ev.Args,
+			Tests:      ev.Tests,
+		})
+		return
+	}
+	go execute(ctx, cancel, r.hub, r.ID, info, &executor.Request{
+		Code:       code,
+		Entrypoint: entrypoint,
+		Files:      files,
+		Stdin:      ev.Stdin,
+		Args:       ev.Args,
+		Timeout:    runTimeout,
+	})
+}
+
+// running reports whether a run is in progress. A run executed by another
+// instance is given up on once that instance stops vouching for it, so that
+// one going away mid-run doesn't keep the session from running code.
+func (r *Room) running() bool {
+	run := r.activeRun
+	if run == nil {
+		return false
+	}
+	if run.cancel == nil && time.Now().After(run.expires) {
+		log.Printf("Run %s in session %s not heard of in %s, giving up on it", run.ID, r.ID, runLease)
+		r.activeRun = nil
+		return false
+	}
+	return true
+}
+
+// keepRunAlive tells the session that a run is still in progress until ctx
+// is done.
+func keepRunAlive(ctx context.Context, hub *Hub, sessionID, runID string) {
+	ticker := time.NewTicker(runHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hub.publish(&Event{Type: eventRunAlive, SessionID: sessionID, RunID: runID})
+		}
+	}
+}
+
+// extendRun pushes back when a run executed elsewhere is given up on.
+func (r *Room) extendRun(ev *Event) {
+	if r.activeRun != nil && r.activeRun.ID == ev.RunID {
+		r.activeRun.expires = time.Now().Add(runLease)
+	}
+}
+
+// abandonRun ends the run in progress if the connection that started it has
+// left, wherever it is executed.
+func (r *Room) abandonRun(connID string) {
+	run := r.activeRun
+	if run == nil || run.ConnID != connID {
+		return
+	}
+	if run.cancel != nil {
+		log.Printf("Run %s in session %s cancelled as its connection left", run.ID, r.ID)
+		run.cancel()
+	}
+	r.activeRun = nil
+}
+
+// announceRun tells the local clients who ran what.
+func (r *Room) announceRun(info *RunInfo) {
+	if info == nil {
+		return
+	}
+	r.broadcast(encodeMessage("run-started", info), "")
+}
+
+// execute runs req, publishes its output and exit, and records the run in
+// the session's history. It runs on its own goroutine and only talks to the
+// session through the backplane.
+func execute(ctx context.Context, cancel context.CancelFunc, hub *Hub, sessionID string, info *RunInfo, req *executor.Request) {
+	defer cancel()
+
+	runID, language := info.ID, info.Language
+	out := &runOutput{hub: hub, sessionID: sessionID, runID: runID}
+	start := time.Now()
+
+	var result *executor.Result
+	var err error
+	if hub.Runner != nil {
+		req.Stdout = out.stream(streamStdout)
+		req.Stderr = out.stream(streamStderr)
+		req.Owner = info.owner(sessionID)
+		req.Queued = func(position int) {
+			hub.PublishRunQueued(sessionID, runID, position)
+		}
+		result, err = hub.Runner.Execute(ctx, language, req)
+	} else {
+		err = errRunsUnavailable
+	}
+	out.close()
+
+	exit := executor.NewResponse(result, err, time.Since(start))
+	recordRun(hub, sessionID, info, exit)
+
+	// The output has been streamed already. Compiler output has not, so it
+	// goes along with the diagnostics.
+	exit.Output, exit.Stdout = "", ""
+	if exit.Diagnostics == nil {
+		exit.Stderr = ""
+	}
+
+	hub.publish(&Event{Type: eventRunExit, SessionID: sessionID, RunID: runID, Exit: &exit})
+}
+
+// executeTests runs code against test cases and publishes the results, like
+// execute. Their output is part of the results, so none is streamed.
+func executeTests(ctx context.Context, cancel context.CancelFunc, hub *Hub, sessionID string, info *RunInfo, req *models.ExecuteTestsRequest) {
+	defer cancel()
+
+	if hub.Runner == nil {
+		exit := executor.NewResponse(nil, errRunsUnavailable, 0)
+		hub.publish(&Event{Type: eventRunExit, SessionID: sessionID, RunID: info.ID, Exit: &exit})
+		return
+	}
+	results := executor.RunTests(ctx, hub.Runner.Execute, req, info.owner(sessionID))
+
+	// The run as a whole succeeds if every case passes.
+	exit := models.ExecuteResponse{
+		Success:       results.Passed == results.Total,
+		ExecutionTime: results.ExecutionTime,
+	}
+	if !exit.Success {
+		exit.Error = fmt.Sprintf("%d of %d tests failed", results.Total-results.Passed, results.Total)
+	}
+	recordRun(hub, sessionID, info, exit)
+
+	hub.publish(&Event{Type: eventRunExit, SessionID: sessionID, RunID: info.ID, Exit: &exit, TestResults: &results})
+}
+
+// recordRun adds a finished run to the session's history.
+func recordRun(hub *Hub, sessionID string, info *RunInfo, exit models.ExecuteResponse) {
+	if hub.store == nil {
+		return
+	}
+	run := &models.Run{
+		ID:        info.ID,
+		SessionID: sessionID,
+		UserID:    info.UserID,
+		UserName:  info.UserName,
+		Language:  info.Language,
+		CodeHash:  info.CodeHash,
+	}
+	run.Finish(exit)
+	hub.store.RecordRun(run)
+}
+
+// cancelRun stops the run in progress if this instance is executing it.
+func (r *Room) cancelRun(ev *Event) {
+	if !r.allowed(ev, session.ActionRun, "run-cancel") {
+		return
+	}
+	if r.activeRun == nil || r.activeRun.cancel == nil {
+		return
+	}
+	if ev.RunID != "" && ev.RunID != r.activeRun.ID {
+		return
+	}
+	log.Printf("Run %s in session %s cancelled by %s", r.activeRun.ID, r.ID, r.userOf(ev.ConnID))
+	r.activeRun.cancel()
+}
+
+func (r *Room) relayRunQueued(ev *Event) {
+	r.extendRun(ev)
+	r.broadcast(encodeMessage("run-queued", map[string]interface{}{
+		"runId":    ev.RunID,
+		"position": ev.Position,
+	}), "")
+}
+
+func (r *Room) relayRunOutput(ev *Event) {
+	r.extendRun(ev)
+	msgType := "run-stdout"
+	if ev.Stream == streamStderr {
+		msgType = "run-stderr"
+	}
+	r.broadcast(encodeMessage(msgType, map[string]interface{}{
+		"runId": ev.RunID,
+		"data":  ev.Data,
+	}), "")
+}
+
+func (r *Room) endRun(ev *Event) {
+	if r.activeRun != nil && r.activeRun.ID == ev.RunID {
+		r.activeRun = nil
+	}
+	if ev.Exit == nil {
+		return
+	}
+	r.broadcast(encodeMessage("run-exit", struct {
+		RunID string `json:"runId"`
+		models.ExecuteResponse
+		Tests *models.ExecuteTestsResponse `json:"tests,omitempty"`
+	}{ev.RunID, *ev.Exit, ev.TestResults}), "")
+}
+
+// runOutput batches a run's output and publishes it to the session.
+type runOutput struct {
+	hub       *Hub
+	sessionID string
+	runID     string
+
+	// publishMu keeps chunks in order when a timed flush and the final
+	// one overlap. It also guards partial.
+	publishMu sync.Mutex
+	// partial holds, per stream, the start of a character whose remaining
+	// bytes haven't been written yet, so a character is never split
+	// between two events.
+	partial map[string][]byte
+
+	mu     sync.Mutex
+	chunks []outputChunk
+	timer  *time.Timer
+	closed bool
+}
+
+type outputChunk struct {
+	stream string
+	data   []byte
+}
+
+// stream returns a writer for one of the run's streams.
+func (o *runOutput) stream(name string) io.Writer {
+	return streamWriter{out: o, name: name}
+}
+
+func (o *runOutput) write(stream string, p []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+
+	if n := len(o.chunks); n > 0 && o.chunks[n-1].stream == stream {
+		o.chunks[n-1].data = append(o.chunks[n-1].data, p...)
+	} else {
+		o.chunks = append(o.chunks, outputChunk{stream: stream, data: append([]byte(nil), p...)})
+	}
+	if o.timer == nil {
+		o.timer = time.AfterFunc(runFlushInterval, o.flush)
+	}
+}
+
+// flush publishes the output written so far.
+func (o *runOutput) flush() {
+	o.publishMu.Lock()
+	defer o.publishMu.Unlock()
+
+	o.mu.Lock()
+	chunks := o.chunks
+	o.chunks = nil
+	o.timer = nil
+	final := o.closed
+	o.mu.Unlock()
+
+	if o.partial == nil {
+		o.partial = make(map[string][]byte)
+	}
+	for _, chunk := range chunks {
+		data := append(o.partial[chunk.stream], chunk.data...)
+		delete(o.partial, chunk.stream)
+		if !final {
+			if n := incompleteTail(data); n > 0 {
+				o.partial[chunk.stream] = append([]byte(nil), data[len(data)-n:]...)
+				data = data[:len(data)-n]
+			}
+		}
+		o.publish(chunk.stream, data)
+	}
+	if final {
+		// The program ended partway through a character.
+		for _, stream := range []string{streamStdout, streamStderr} {
+			o.publish(stream, o.partial[stream])
+		}
+		o.partial = nil
+	}
+}
+
+func (o *runOutput) publish(stream string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	o.hub.publish(&Event{
+		Type:      eventRunOutput,
+		SessionID: o.sessionID,
+		RunID:     o.runID,
+		Stream:    stream,
+		Data:      string(data),
+	})
+}
+
+// incompleteTail returns how many bytes at the end of p start a UTF-8
+// character that is missing the rest of its bytes.
+func incompleteTail(p []byte) int {
+	for n := 1; n <= utf8.UTFMax && n <= len(p); n++ {
+		if utf8.RuneStart(p[len(p)-n]) {
+			if utf8.FullRune(p[len(p)-n:]) {
+				return 0
+			}
+			return n
+		}
+	}
+	return 0
+}
+
+// close publishes the remaining output. Nothing written afterwards is sent.
+func (o *runOutput) close() {
+	o.mu.Lock()
+	o.closed = true
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.mu.Unlock()
+	o.flush()
+}
+
+type streamWriter struct {
+	out  *runOutput
+	name string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.out.write(w.name, p)
+	return len(p), nil
+}
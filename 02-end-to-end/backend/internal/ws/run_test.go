@@ -0,0 +1,328 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"backend/internal/executor"
+	"backend/internal/models"
+
+	"github.com/google/uuid"
+)
+
+type runnerFunc func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error)
+
+func (f runnerFunc) Execute(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+	return f(ctx, language, req)
+}
+
+type runMessage struct {
+	RunID         string `json:"runId"`
+	Data          string `json:"data"`
+	Success       bool   `json:"success"`
+	ExitCode      int    `json:"exitCode"`
+	Stdout        string `json:"stdout"`
+	Error         string `json:"error"`
+	LimitExceeded string `json:"limitExceeded"`
+
+	Tests *models.ExecuteTestsResponse `json:"tests"`
+}
+
+func decodeRun(t *testing.T, msg testMessage) runMessage {
+	t.Helper()
+	var data runMessage
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		t.Fatalf("Invalid %s: %v", msg.Type, err)
+	}
+	return data
+}
+
+func TestRunStreamsOutputToSession(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print(1)", Language: "python"}
+
+	release := make(chan struct{})
+	hub := NewHub(store)
+	hub.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		if language != "python" || req.Code != "print(1)" {
+			t.Errorf("Ran %s %q", language, req.Code)
+		}
+		io.WriteString(req.Stdout, "step 1\n")
+		<-release
+		io.WriteString(req.Stderr, "warning\n")
+		io.WriteString(req.Stdout, "step 2\n")
+		return &executor.Result{Stdout: "step 1\nstep 2\n", Stderr: "warning\n"}, nil
+	})
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- alice
+	hub.Register <- bob
+	nextMessage(t, alice, "session-state")
+	nextMessage(t, bob, "session-state")
+
+	runID := uuid.New().String()
+	alice.publish(&Event{Type: eventRun, RunID: runID})
+
+	if started := decodeRun(t, nextMessage(t, bob, "run-started")); started.RunID != runID {
+		t.Errorf("Unexpected run-started %+v", started)
+	}
+	// Output arrives while the program is still running.
+	if out := decodeRun(t, nextMessage(t, bob, "run-stdout")); out.Data != "step 1\n" || out.RunID != runID {
+		t.Errorf("Unexpected run-stdout %+v", out)
+	}
+	close(release)
+
+	if out := decodeRun(t, nextMessage(t, bob, "run-stderr")); out.Data != "warning\n" {
+		t.Errorf("Unexpected run-stderr %+v", out)
+	}
+	if out := decodeRun(t, nextMessage(t, bob, "run-stdout")); out.Data != "step 2\n" {
+		t.Errorf("Unexpected run-stdout %+v", out)
+	}
+	exit := decodeRun(t, nextMessage(t, bob, "run-exit"))
+	if !exit.Success || exit.RunID != runID || exit.Stdout != "" {
+		t.Errorf("Unexpected run-exit %+v", exit)
+	}
+
+	// The one who started it sees the same.
+	nextMessage(t, alice, "run-stdout")
+	nextMessage(t, alice, "run-exit")
+
+	// The run is in the session's history, with its full output.
+	runs := store.recordedRuns()
+	if len(runs) != 1 {
+		t.Fatalf("Expected 1 recorded run, got %d", len(runs))
+	}
+	if run := runs[0]; run.ID != runID || run.UserID != "alice" || run.CodeHash != executor.CodeHash("print(1)", nil) || run.Stdout != "step 1\nstep 2\n" {
+		t.Errorf("Unexpected recorded run %+v", run)
+	}
+}
+
+func TestRunOutputKeepsCharactersWhole(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print('café')", Language: "python"}
+
+	hub := NewHub(store)
+	hub.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		// "é" written in two halves, far enough apart to be flushed
+		// separately.
+		req.Stdout.Write([]byte("caf\xc3"))
+		time.Sleep(3 * runFlushInterval)
+		req.Stdout.Write([]byte("\xa9\n"))
+		return &executor.Result{Stdout: "café\n"}, nil
+	})
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+	alice.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+
+	var stdout string
+	for {
+		var msg testMessage
+		select {
+		case raw := <-alice.SendChan:
+			json.Unmarshal(raw, &msg)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for run-exit")
+		}
+		if msg.Type == "run-exit" {
+			break
+		}
+		if msg.Type == "run-stdout" {
+			stdout += decodeRun(t, msg).Data
+		}
+	}
+	if stdout != "café\n" {
+		t.Errorf("streamed stdout %q, want %q", stdout, "café\n")
+	}
+}
+
+func TestRunUsesSessionFiles(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "import utils", Language: "python", Entrypoint: "main.py"}
+
+	ran := make(chan *executor.Request, 1)
+	hub := NewHub(store)
+	hub.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		ran <- req
+		return &executor.Result{}, nil
+	})
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+
+	alice.publish(&Event{Type: eventFileCreate, Path: "utils.py", Content: "x = 1"})
+	alice.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+	nextMessage(t, alice, "run-exit")
+
+	req := <-ran
+	if req.Code != "import utils" || req.Entrypoint != "main.py" || len(req.Files) != 1 || req.Files["utils.py"] != "x = 1" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+	if runs := store.recordedRuns(); runs[0].CodeHash != executor.CodeHash(req.Code, req.Files) {
+		t.Errorf("Expected the hash to cover every file")
+	}
+}
+
+func TestRunTestsInSession(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "print(input())", Language: "python"}
+
+	hub := NewHub(store)
+	hub.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		return &executor.Result{Stdout: req.Stdin}, nil
+	})
+	go hub.Run()
+
+	alice := newTestClient(hub, "s1", "alice")
+	hub.Register <- alice
+	nextMessage(t, alice, "session-state")
+
+	runID := uuid.New().String()
+	alice.publish(&Event{Type: eventRun, RunID: runID, Tests: []models.TestCase{
+		{Stdin: "1\n", ExpectedOutput: "1\n"},
+		{Stdin: "2\n", ExpectedOutput: "3\n"},
+	}})
+	nextMessage(t, alice, "run-started")
+
+	exit := decodeRun(t, nextMessage(t, alice, "run-exit"))
+	if exit.Success || exit.Error != "1 of 2 tests failed" || exit.Tests == nil {
+		t.Fatalf("Unexpected run-exit %+v", exit)
+	}
+	if exit.Tests.Passed != 1 || !exit.Tests.Results[0].Passed || exit.Tests.Results[1].Diff != "-3\n+2\n" {
+		t.Errorf("Unexpected test results %+v", exit.Tests)
+	}
+
+	if runs := store.recordedRuns(); len(runs) != 1 || runs[0].Success {
+		t.Errorf("Expected a failed run in the history, got %+v", runs)
+	}
+}
+
+func TestRunsOutsideTheSessionAreShared(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1"}
+
+	hub := NewHub(store)
+	go hub.Run()
+
+	bob := newTestClient(hub, "s1", "bob")
+	hub.Register <- bob
+	nextMessage(t, bob, "session-state")
+
+	hub.PublishRunStarted("s1", &RunInfo{ID: "r1", UserID: "alice", UserName: "Alice", Language: "go", CodeHash: "abc"})
+	var started RunInfo
+	if err := json.Unmarshal(nextMessage(t, bob, "run-started").Data, &started); err != nil {
+		t.Fatalf("Invalid run-started: %v", err)
+	}
+	if started.UserName != "Alice" || started.Language != "go" || started.CodeHash != "abc" {
+		t.Errorf("Unexpected run-started %+v", started)
+	}
+
+	hub.PublishRunExit("s1", "r1", &models.ExecuteResponse{Success: true, Stdout: "hi\n"})
+	if exit := decodeRun(t, nextMessage(t, bob, "run-exit")); exit.RunID != "r1" || exit.Stdout != "hi\n" {
+		t.Errorf("Unexpected run-exit %+v", exit)
+	}
+}
+
+func TestRunCancelFromAnotherInstance(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "while True: pass", Language: "python"}
+
+	backplane := NewMemoryBackplane()
+	hubA := NewHubWithBackplane(store, backplane)
+	hubA.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	hubB := NewHubWithBackplane(store, backplane)
+	go hubA.Run()
+	go hubB.Run()
+
+	alice := newTestClient(hubA, "s1", "alice")
+	hubA.Register <- alice
+	nextMessageWithin(t, alice, "session-state", 3*time.Second)
+
+	bob := newTestClient(hubB, "s1", "bob")
+	hubB.Register <- bob
+	nextMessage(t, bob, "session-state")
+
+	runID := uuid.New().String()
+	alice.publish(&Event{Type: eventRun, RunID: runID})
+	nextMessage(t, bob, "run-started")
+
+	// One run at a time.
+	bob.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+	nextMessage(t, bob, "run-rejected")
+
+	bob.publish(&Event{Type: eventRunCancel, RunID: runID})
+	exit := decodeRun(t, nextMessage(t, alice, "run-exit"))
+	if exit.Success || exit.Error != "execution cancelled" {
+		t.Errorf("Unexpected run-exit %+v", exit)
+	}
+	nextMessage(t, bob, "run-exit")
+
+	// The session can run again.
+	bob.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+	nextMessage(t, bob, "run-started")
+}
+
+func TestRunEndsWhenItsConnectionLeaves(t *testing.T) {
+	store := newFakeStore()
+	store.sessions["s1"] = &models.Session{ID: "s1", Code: "while True: pass", Language: "python"}
+
+	backplane := NewMemoryBackplane()
+	hubA := NewHubWithBackplane(store, backplane)
+	hubA.Runner = runnerFunc(func(ctx context.Context, language string, req *executor.Request) (*executor.Result, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	hubB := NewHubWithBackplane(store, backplane)
+	go hubA.Run()
+	go hubB.Run()
+
+	alice := newTestClient(hubA, "s1", "alice")
+	hubA.Register <- alice
+	nextMessageWithin(t, alice, "session-state", 3*time.Second)
+
+	bob := newTestClient(hubB, "s1", "bob")
+	hubB.Register <- bob
+	nextMessage(t, bob, "session-state")
+
+	alice.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+	nextMessage(t, bob, "run-started")
+
+	// The run goes with the connection that started it.
+	hubA.Unregister <- alice
+	nextMessage(t, bob, "user-left")
+	bob.publish(&Event{Type: eventRun, RunID: uuid.New().String()})
+	nextMessage(t, bob, "run-started")
+}
+
+func TestRunFromAnotherInstanceExpires(t *testing.T) {
+	room := newRoom(nil, "s1", nil)
+
+	room.activeRun = &ActiveRun{ID: "r1", expires: time.Now().Add(time.Minute)}
+	if !room.running() {
+		t.Fatal("Expected the run to be in progress")
+	}
+
+	// Its instance stopped vouching for it.
+	room.activeRun.expires = time.Now().Add(-time.Second)
+	if room.running() || room.activeRun != nil {
+		t.Error("Expected the run to be given up on")
+	}
+
+	// A run this instance executes only ends with it.
+	room.activeRun = &ActiveRun{ID: "r2", expires: time.Now().Add(-time.Second), cancel: func() {}}
+	if !room.running() {
+		t.Error("Expected the local run to be in progress")
+	}
+}
@@ -2,19 +2,23 @@ package main_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"backend/internal/api"
 	"backend/internal/db"
+	"backend/internal/executor"
 	"backend/internal/models"
 	"backend/internal/session"
 	"backend/internal/users"
 	"backend/internal/ws"
 
+	"github.com/gorilla/websocket"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
@@ -24,10 +28,18 @@ func setupTestDB() {
 	if err != nil {
 		panic("failed to connect database")
 	}
-	d.AutoMigrate(&models.User{}, &models.Session{})
+	d.AutoMigrate(&models.User{}, &models.RefreshToken{}, &models.RevokedToken{}, &models.Session{}, &models.SessionFile{}, &models.SessionMember{}, &models.Invite{}, &models.Run{})
 	db.DB = d
 }
 
+// echoExecutor stands in for the Python runtime, which is not installed
+// where the tests run.
+type echoExecutor struct{}
+
+func (echoExecutor) Run(ctx context.Context, req *executor.Request) (*executor.Result, error) {
+	return &executor.Result{Stdout: "Hello from test\n"}, nil
+}
+
 func TestBackendFlow(t *testing.T) {
 	setupTestDB()
 
@@ -37,10 +49,11 @@ func TestBackendFlow(t *testing.T) {
 	// Setup Server
 	store := session.NewStore()
 	userStore := users.NewStore()
-	hub := ws.NewHub()
+	hub := ws.NewHub(store)
 	go hub.Run() // Start the hub if needed, though for this flow it's minimal usage by broadcast
 
 	server := api.NewServer(store, userStore, hub)
+	server.Executor.Register("python", echoExecutor{})
 	mux := server.SetupRoutes()
 
 	// Create test server
@@ -77,13 +90,48 @@ func TestBackendFlow(t *testing.T) {
 	token := authResp["token"]
 	t.Log("Got token")
 
+	// A refresh token gets a new token, once.
+	t.Log("Refreshing token...")
+	refresh := func(refreshToken string) (models.AuthResponse, int) {
+		body, _ := json.Marshal(map[string]string{"refreshToken": refreshToken})
+		resp, err := http.Post(baseURL+"/token/refresh", "application/json", bytes.NewBuffer(body))
+		if err != nil {
+			t.Fatalf("Failed to refresh token: %v", err)
+		}
+		defer resp.Body.Close()
+		var refreshed models.AuthResponse
+		json.NewDecoder(resp.Body).Decode(&refreshed)
+		return refreshed, resp.StatusCode
+	}
+	refreshed, status := refresh(authResp["refreshToken"])
+	if status != http.StatusOK || refreshed.Token == "" || refreshed.RefreshToken == "" {
+		t.Fatalf("Expected 200 OK with new tokens, got %d %+v", status, refreshed)
+	}
+	if _, status := refresh(authResp["refreshToken"]); status != http.StatusUnauthorized {
+		t.Errorf("Expected a used refresh token to be refused, got %d", status)
+	}
+
 	client := ts.Client() // Use the client configured for the test server? Or standard
 
 	// 1. Create Session
 	t.Log("Creating session...")
+	body, _ = json.Marshal(map[string]string{"language": "cobol"})
+	req, _ := http.NewRequest("POST", baseURL+"/sessions", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer resp.Body.Close()
+	var unsupported models.UnsupportedLanguageResponse
+	json.NewDecoder(resp.Body).Decode(&unsupported)
+	if resp.StatusCode != http.StatusBadRequest || len(unsupported.SupportedLanguages) != 3 {
+		t.Errorf("Expected 400 with the supported languages, got %d %+v", resp.StatusCode, unsupported)
+	}
+
 	sessReq := map[string]string{"language": "python"}
 	body, _ = json.Marshal(sessReq)
-	req, _ := http.NewRequest("POST", baseURL+"/sessions", bytes.NewBuffer(body))
+	req, _ = http.NewRequest("POST", baseURL+"/sessions", bytes.NewBuffer(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
 
@@ -105,7 +153,7 @@ func TestBackendFlow(t *testing.T) {
 	// 2. Get Session
 	t.Log("Getting session info...")
 	req, _ = http.NewRequest("GET", baseURL+"/sessions/"+sessionID, nil)
-	// req.Header.Set("Authorization", "Bearer "+token) // assuming public/unprotected for plain GET as per prior logic
+	req.Header.Set("Authorization", "Bearer "+token)
 
 	resp, err = client.Do(req)
 	if err != nil {
@@ -115,12 +163,45 @@ func TestBackendFlow(t *testing.T) {
 	if resp.StatusCode != http.StatusOK {
 		t.Fatalf("Expected 200 OK, got %d", resp.StatusCode)
 	}
+	var sess models.Session
+	json.NewDecoder(resp.Body).Decode(&sess)
+	if python, _ := server.Languages.Get("python"); sess.Code != python.Template {
+		t.Errorf("Expected the session to start from the Python template, got %q", sess.Code)
+	}
+	if sess.Entrypoint != "main.py" || len(sess.Files) != 1 || sess.Files[0].Path != "main.py" {
+		t.Errorf("Expected the template in main.py, got %+v", sess.Files)
+	}
+
+	// Tokens are signed with the development secret, which isn't published.
+	resp, err = client.Get(baseURL + "/.well-known/jwks.json")
+	if err != nil {
+		t.Fatalf("Failed to get JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	var jwks map[string][]interface{}
+	json.NewDecoder(resp.Body).Decode(&jwks)
+	if resp.StatusCode != http.StatusOK || jwks["keys"] == nil || len(jwks["keys"]) != 0 {
+		t.Errorf("Expected an empty key set, got %d %v", resp.StatusCode, jwks)
+	}
+
+	// The languages a session can be written in.
+	resp, err = client.Get(baseURL + "/languages")
+	if err != nil {
+		t.Fatalf("Failed to list languages: %v", err)
+	}
+	defer resp.Body.Close()
+	var langs []map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&langs)
+	if len(langs) != 3 || langs[1]["id"] != "python" || langs[1]["executor"] != nil {
+		t.Errorf("Unexpected languages %v", langs)
+	}
 
 	// 3. Execute Code
 	t.Log("Executing code...")
 	execReq := map[string]string{
-		"code":     "print('Hello from test')",
-		"language": "python",
+		"code":      "print('Hello from test')",
+		"language":  "python",
+		"sessionId": sessionID,
 	}
 	body, _ = json.Marshal(execReq)
 	req, _ = http.NewRequest("POST", baseURL+"/execute", bytes.NewBuffer(body))
@@ -147,4 +228,260 @@ func TestBackendFlow(t *testing.T) {
 	if execResp["success"] != true {
 		t.Errorf("Execution failed")
 	}
+
+	// 4. Run History
+	t.Log("Getting run history...")
+	req, _ = http.NewRequest("GET", baseURL+"/sessions/"+sessionID+"/runs", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to get run history: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", resp.StatusCode)
+	}
+
+	var runs []models.Run
+	json.NewDecoder(resp.Body).Decode(&runs)
+	if len(runs) != 1 || runs[0].UserName != "testuser" || !runs[0].Success {
+		t.Errorf("Expected the run in the session's history, got %+v", runs)
+	}
+
+	// 5. Members
+	t.Log("Adding an observer...")
+	body, _ = json.Marshal(map[string]string{"username": "observer", "password": "password123"})
+	resp, err = http.Post(baseURL+"/register", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	defer resp.Body.Close()
+	json.NewDecoder(resp.Body).Decode(&authResp)
+	observerToken := authResp["token"]
+
+	get := func(token string) int {
+		req, _ := http.NewRequest("GET", baseURL+"/sessions/"+sessionID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to get session: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := get(observerToken); status != http.StatusForbidden {
+		t.Errorf("Expected 403 for a user who isn't a member, got %d", status)
+	}
+
+	body, _ = json.Marshal(map[string]string{"username": "observer", "role": "observer"})
+	req, _ = http.NewRequest("POST", baseURL+"/sessions/"+sessionID+"/members", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to add member: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", resp.StatusCode)
+	}
+	if status := get(observerToken); status != http.StatusOK {
+		t.Errorf("Expected an observer to read the session, got %d", status)
+	}
+
+	// An observer can't run code in the session.
+	body, _ = json.Marshal(execReq)
+	req, _ = http.NewRequest("POST", baseURL+"/execute", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+observerToken)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to execute code: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for an observer's run, got %d", resp.StatusCode)
+	}
+
+	// 6. Invites
+	t.Log("Inviting a candidate...")
+	body, _ = json.Marshal(map[string]interface{}{"role": "candidate", "expiresIn": 3600})
+	req, _ = http.NewRequest("POST", baseURL+"/sessions/"+sessionID+"/invites", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create invite: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d", resp.StatusCode)
+	}
+	var invite models.CreateInviteResponse
+	json.NewDecoder(resp.Body).Decode(&invite)
+
+	// The link alone doesn't open the session: whoever holds it has to pick
+	// a name and join as a guest first.
+	resp, err = client.Get(baseURL + "/sessions/" + sessionID + "?invite=" + invite.Token)
+	if err != nil {
+		t.Fatalf("Failed to get session: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected an invite without a guest token to be refused, got %d", resp.StatusCode)
+	}
+
+	// 7. Guests
+	t.Log("Joining as a guest...")
+	body, _ = json.Marshal(map[string]string{"invite": invite.Token, "name": "Ada"})
+	resp, err = http.Post(baseURL+"/sessions/"+sessionID+"/guests", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to join as a guest: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201 Created, got %d", resp.StatusCode)
+	}
+	var guest models.JoinAsGuestResponse
+	json.NewDecoder(resp.Body).Decode(&guest)
+	if guest.Username != "Ada" || guest.Role != "candidate" {
+		t.Errorf("Unexpected guest %+v", guest)
+	}
+	if status := get(guest.Token); status != http.StatusOK {
+		t.Errorf("Expected the guest to read the session, got %d", status)
+	}
+
+	// A guest can only join the session they were invited to.
+	req, _ = http.NewRequest("POST", baseURL+"/sessions", bytes.NewBufferString(`{"language":"python"}`))
+	req.Header.Set("Authorization", "Bearer "+guest.Token)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected 403 for a guest creating a session, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("DELETE", baseURL+"/sessions/"+sessionID+"/invites/"+invite.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to revoke invite: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content, got %d", resp.StatusCode)
+	}
+	body, _ = json.Marshal(map[string]string{"invite": invite.Token, "name": "Grace"})
+	resp, err = http.Post(baseURL+"/sessions/"+sessionID+"/guests", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to join as a guest: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked invite to be refused, got %d", resp.StatusCode)
+	}
+	if status := get(guest.Token); status != http.StatusUnauthorized {
+		t.Errorf("Expected the guest of a revoked invite to be refused, got %d", status)
+	}
+
+	// 8. Logout
+	t.Log("Logging out...")
+	body, _ = json.Marshal(map[string]string{"refreshToken": authResp["refreshToken"]})
+	req, _ = http.NewRequest("POST", baseURL+"/logout", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+observerToken)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to log out: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 No Content, got %d", resp.StatusCode)
+	}
+	if status := get(observerToken); status != http.StatusUnauthorized {
+		t.Errorf("Expected the token to be revoked, got %d", status)
+	}
+	if _, status := refresh(authResp["refreshToken"]); status != http.StatusUnauthorized {
+		t.Errorf("Expected the refresh token to be revoked, got %d", status)
+	}
+}
+
+// signUp registers a user and returns their token and ID.
+func signUp(t *testing.T, baseURL, username string) (token, userID string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"username": username, "password": "password123"})
+	resp, err := http.Post(baseURL+"/register", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatalf("Failed to register: %v", err)
+	}
+	defer resp.Body.Close()
+	var auth models.AuthResponse
+	json.NewDecoder(resp.Body).Decode(&auth)
+	if auth.Token == "" {
+		t.Fatalf("Expected a token for %s, got status %d", username, resp.StatusCode)
+	}
+	return auth.Token, auth.UserID
+}
+
+func TestLegacySessionClaimedOnlyByJoining(t *testing.T) {
+	setupTestDB()
+
+	store := session.NewStore()
+	hub := ws.NewHub(store)
+	go hub.Run()
+	ts := httptest.NewServer(api.NewServer(store, users.NewStore(), hub).SetupRoutes())
+	defer ts.Close()
+
+	token, userID := signUp(t, ts.URL, "legacy-candidate")
+	strangerToken, _ := signUp(t, ts.URL, "legacy-stranger")
+
+	// A session from before sessions had owners, where the user ran code.
+	db.GetDB().Create(&models.Session{ID: "legacy", Language: "python", Code: "print(1)"})
+	store.RecordRun(&models.Run{ID: "legacy-run", SessionID: "legacy", UserID: userID})
+
+	get := func(path, token string) int {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	owner := func() string {
+		var s models.Session
+		db.GetDB().First(&s, "id = ?", "legacy")
+		return s.OwnerID
+	}
+
+	// Reading the session changes nothing, and managing it is refused.
+	for _, path := range []string{"/sessions/legacy", "/sessions/legacy/runs", "/sessions/legacy/members"} {
+		if status := get(path, strangerToken); status != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, status)
+		}
+	}
+	if status := get("/sessions/legacy/invites", strangerToken); status != http.StatusForbidden {
+		t.Errorf("GET invites = %d, want 403", status)
+	}
+	if owner() != "" {
+		t.Fatalf("Expected reading the session not to claim it, owned by %q", owner())
+	}
+
+	// Joining doesn't let someone who never took part claim it.
+	dial := func(token string) {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/sessions/legacy?token="+token, nil)
+		if err != nil {
+			t.Fatalf("Failed to join: %v", err)
+		}
+		conn.Close()
+	}
+	dial(strangerToken)
+	if owner() != "" {
+		t.Fatalf("Expected a stranger not to claim the session, owned by %q", owner())
+	}
+
+	dial(token)
+	if owner() != userID {
+		t.Errorf("Expected the user who ran code in it to claim it, owned by %q", owner())
+	}
 }
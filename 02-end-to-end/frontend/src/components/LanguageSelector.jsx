@@ -1,3 +1,4 @@
+import { useEffect, useState } from 'react';
 import { ChevronDown, FileCode2 } from 'lucide-react';
 import {
   Select,
@@ -7,13 +8,35 @@ import {
   SelectValue,
 } from '@/components/ui/select';
 
-const languages = [
+const icons = {
+  javascript: '🟨',
+  python: '🐍',
+  go: '🔵',
+};
+
+// Shown until the server's list of languages arrives.
+const fallbackLanguages = [
   { value: 'javascript', label: 'JavaScript', icon: '🟨' },
   { value: 'python', label: 'Python', icon: '🐍' },
   { value: 'go', label: 'Go', icon: '🔵' },
 ];
 
 const LanguageSelector = ({ value, onChange }) => {
+  const [languages, setLanguages] = useState(fallbackLanguages);
+
+  useEffect(() => {
+    fetch('http://localhost:8080/languages')
+      .then((response) => (response.ok ? response.json() : Promise.reject(response.status)))
+      .then((list) => {
+        setLanguages(list.map((lang) => ({
+          value: lang.id,
+          label: lang.version ? `${lang.name} ${lang.version}` : lang.name,
+          icon: icons[lang.id] || '📄',
+        })));
+      })
+      .catch((error) => console.error('Failed to load languages:', error));
+  }, []);
+
   return (
     <Select value={value} onValueChange={onChange}>
       <SelectTrigger className="w-44 bg-secondary/80 border-panel-border hover:bg-secondary transition-colors">
@@ -2,6 +2,9 @@ import { createContext, useContext, useState, useEffect } from 'react';
 
 const AuthContext = createContext(null);
 
+// How long before the token expires it is refreshed, in milliseconds.
+const REFRESH_MARGIN = 60 * 1000;
+
 export const AuthProvider = ({ children }) => {
     const [user, setUser] = useState(null);
     const [token, setToken] = useState(localStorage.getItem('token'));
@@ -15,6 +18,15 @@ export const AuthProvider = ({ children }) => {
             try {
                 const payload = JSON.parse(atob(token.split('.')[1]));
                 setUser({ username: payload.username, id: payload.userId });
+
+                // Tokens are short-lived; trade the refresh token for a new
+                // one shortly before this one expires.
+                if (payload.exp) {
+                    const delay = Math.max(payload.exp * 1000 - Date.now() - REFRESH_MARGIN, 0);
+                    const timer = setTimeout(refresh, delay);
+                    setLoading(false);
+                    return () => clearTimeout(timer);
+                }
             } catch (e) {
                 logout();
             }
@@ -22,6 +34,38 @@ export const AuthProvider = ({ children }) => {
         setLoading(false);
     }, [token]);
 
+    const saveTokens = (data) => {
+        setToken(data.token);
+        localStorage.setItem('token', data.token);
+        if (data.refreshToken) {
+            localStorage.setItem('refreshToken', data.refreshToken);
+        }
+        setUser({ username: data.username, id: data.userId });
+    };
+
+    const refresh = async () => {
+        const refreshToken = localStorage.getItem('refreshToken');
+        try {
+            if (!refreshToken) {
+                throw new Error('No refresh token');
+            }
+            const response = await fetch('http://localhost:8080/token/refresh', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ refreshToken }),
+            });
+
+            if (!response.ok) {
+                throw new Error('Refresh failed');
+            }
+
+            saveTokens(await response.json());
+        } catch (error) {
+            console.error(error);
+            logout();
+        }
+    };
+
     const login = async (username, password) => {
         try {
             const response = await fetch('http://localhost:8080/login', {
@@ -34,10 +78,7 @@ export const AuthProvider = ({ children }) => {
                 throw new Error('Login failed');
             }
 
-            const data = await response.json();
-            setToken(data.token);
-            localStorage.setItem('token', data.token);
-            setUser({ username: data.username, id: data.userId });
+            saveTokens(await response.json());
             return true;
         } catch (error) {
             console.error(error);
@@ -57,10 +98,7 @@ export const AuthProvider = ({ children }) => {
                 throw new Error('Registration failed');
             }
 
-            const data = await response.json();
-            setToken(data.token);
-            localStorage.setItem('token', data.token);
-            setUser({ username: data.username, id: data.userId });
+            saveTokens(await response.json());
             return true;
         } catch (error) {
             console.error(error);
@@ -68,10 +106,28 @@ export const AuthProvider = ({ children }) => {
         }
     };
 
-    const logout = () => {
+    const logout = async () => {
+        const refreshToken = localStorage.getItem('refreshToken');
         setToken(null);
         setUser(null);
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
+
+        // Revoke the tokens on the server too, so a copy of them is useless.
+        if (token) {
+            try {
+                await fetch('http://localhost:8080/logout', {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json',
+                        'Authorization': `Bearer ${token}`,
+                    },
+                    body: JSON.stringify({ refreshToken }),
+                });
+            } catch (error) {
+                console.error(error);
+            }
+        }
     };
 
     return (